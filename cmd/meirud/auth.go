@@ -1,8 +1,6 @@
 package main
 
 import (
-	"fmt"
-
 	"github.com/hamcha/meiru/lib/email"
 )
 
@@ -12,13 +10,10 @@ func HandleLocalAuthRequest(username, password string) bool {
 		return false
 	}
 
-	name, host := email.SplitAddress(username)
-	query := fmt.Sprintf("domain:0=%s user:0=%s password", host, name)
-
-	result, err := conf.Query(query)
-	if err != nil || len(result) < 1 || len(result[0].Values) < 1 {
+	user, ok := store.LookupUser(username)
+	if !ok || len(user.Password) < 1 {
 		return false
 	}
 
-	return checkPassword(result[0].Values, password)
+	return checkPassword(user.Password, password)
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hamcha/meiru/lib/email"
+)
+
+// makeBounce creates a non-delivery report for the sender of a message
+func makeBounce(hostname, sender string, recipients []string, data *string, err error) string {
+	return makeReport(hostname, sender, "Undelivered Mail Returned to Sender",
+		"Your message could not be delivered to the following recipients:", recipients, data, err)
+}
+
+// makeDelayNotice warns the sender of a message that it couldn't be delivered
+// yet, and that delivery will be retried until a given time
+func makeDelayNotice(hostname, sender string, recipients []string, data *string, err error, until time.Time) string {
+	return makeReport(hostname, sender, "Delayed Mail (still being retried)",
+		fmt.Sprintf("Your message could not be delivered yet to the following recipients,\r\n"+
+			"delivery will be retried until %s:", until.Format(time.RFC1123Z)), recipients, data, err)
+}
+
+// makeReport creates a delivery status message for the sender of a message
+func makeReport(hostname, sender, subject, intro string, recipients []string, data *string, err error) string {
+	var out strings.Builder
+
+	// Headers
+	fmt.Fprintf(&out, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(&out, "To: <%s>\r\n", sender)
+	fmt.Fprintf(&out, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&out, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&out, "\r\n")
+
+	// Body
+	fmt.Fprintf(&out, "This is the mail system at host %s.\r\n\r\n", hostname)
+	fmt.Fprintf(&out, "%s\r\n\r\n", intro)
+	for _, recipient := range recipients {
+		fmt.Fprintf(&out, "\t<%s>\r\n", recipient)
+	}
+	fmt.Fprintf(&out, "\r\nDiagnostic information:\r\n\r\n")
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintf(&out, "\t%s\r\n", strings.TrimSpace(line))
+	}
+
+	// Include the original headers so the sender knows which message bounced
+	if data != nil {
+		fmt.Fprintf(&out, "\r\n--- Original message headers ---\r\n\r\n")
+		headers := email.Parse(*data).Headers
+		for _, line := range strings.Split(headers, "\n") {
+			fmt.Fprintf(&out, "%s\r\n", strings.TrimRight(line, "\r"))
+		}
+	}
+
+	return out.String()
+}
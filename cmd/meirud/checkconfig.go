@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hamcha/meiru/lib/config"
+)
+
+// runCheckConfig implements "meirud check-config [-config path]", which
+// validates a configuration file and exits with 1 if it has errors
+func runCheckConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	cfgpath := flags.String("config", "conf/meiru.conf", "Path to configuration file")
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig(*cfgpath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	issues := append(cfg.Validate(configSchema), passwordIssues(cfg)...)
+	warnings := 0
+	for _, issue := range issues {
+		if issue.Warning {
+			warnings++
+		}
+		fmt.Println(issue.String())
+	}
+
+	if config.HasErrors(issues) {
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", *cfgpath, len(issues)-warnings, warnings)
+		return 1
+	}
+	fmt.Printf("%s: OK (%d warning(s))\n", *cfgpath, warnings)
+	return 0
+}
+
+// validateConfig checks the loaded configuration before starting,
+// warnings are logged and errors stop the server
+func validateConfig() {
+	issues := append(conf.Validate(configSchema), passwordIssues(conf)...)
+	for _, issue := range issues {
+		log.Printf("[meirud] %s\r\n", issue.String())
+	}
+	if config.HasErrors(issues) {
+		log.Fatalln("[meirud] The configuration has errors, fix them before starting the server again (see 'meirud check-config')")
+	}
+}
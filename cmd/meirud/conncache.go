@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hamcha/meiru/lib/smtp"
+)
+
+// connCache keeps greeted connections to remote mail servers around for a
+// while so that mail sent shortly after can reuse them
+type connCache struct {
+	mutex   sync.Mutex
+	idle    map[string][]cachedConn
+	timeout time.Duration
+}
+
+type cachedConn struct {
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+func newConnCache(timeout time.Duration) *connCache {
+	return &connCache{
+		idle:    make(map[string][]cachedConn),
+		timeout: timeout,
+	}
+}
+
+// get returns an idle connection to a host, or nil if there are none
+func (c *connCache) get(ctx context.Context, host string) *smtp.Client {
+	for {
+		c.mutex.Lock()
+		conns := c.idle[host]
+		if len(conns) < 1 {
+			c.mutex.Unlock()
+			return nil
+		}
+
+		// Take the most recently used, it's the least likely to be closed
+		conn := conns[len(conns)-1]
+		if len(conns) > 1 {
+			c.idle[host] = conns[:len(conns)-1]
+		} else {
+			delete(c.idle, host)
+		}
+		c.mutex.Unlock()
+
+		// Make sure the server didn't hang up on us in the meantime
+		if err := conn.client.Reset(ctx); err == nil {
+			return conn.client
+		}
+		conn.client.Close(ctx)
+	}
+}
+
+// put returns a connection to the cache after a completed transaction
+func (c *connCache) put(host string, client *smtp.Client) {
+	if c.timeout <= 0 {
+		client.Close(context.Background())
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.idle[host] = append(c.idle[host], cachedConn{
+		client:   client,
+		lastUsed: time.Now(),
+	})
+}
+
+// expire closes connections that have been idle for longer than the timeout
+func (c *connCache) expire() {
+	var expired []*smtp.Client
+	deadline := time.Now().Add(-c.timeout)
+
+	c.mutex.Lock()
+	for host, conns := range c.idle {
+		var alive []cachedConn
+		for _, conn := range conns {
+			if conn.lastUsed.Before(deadline) {
+				expired = append(expired, conn.client)
+			} else {
+				alive = append(alive, conn)
+			}
+		}
+		if len(alive) > 0 {
+			c.idle[host] = alive
+		} else {
+			delete(c.idle, host)
+		}
+	}
+	c.mutex.Unlock()
+
+	// Close outside the lock, QUIT needs a round trip
+	for _, client := range expired {
+		client.Close(context.Background())
+	}
+}
+
+// closeAll closes all idle connections
+func (c *connCache) closeAll(ctx context.Context) {
+	c.mutex.Lock()
+	idle := c.idle
+	c.idle = make(map[string][]cachedConn)
+	c.mutex.Unlock()
+
+	for _, conns := range idle {
+		for _, conn := range conns {
+			conn.client.Close(ctx)
+		}
+	}
+}
+
+func (c *connCache) expireLoop(ctx context.Context) {
+	if c.timeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.expire()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ErrSQDANELookupFailed = errors.NewType(ErrSrcSendqueue, "Cannot look up TLSA records of remote mail server")
+)
+
+// lookupDANE returns the DNSSEC-validated TLSA records for a mail server
+// (RFC 7672 section 2.2), or nil if the server doesn't use DANE
+func (s *SendQueue) lookupDANE(host string) ([]dns.TLSA, error) {
+	records, authenticated, err := s.Resolver.LookupTLSA(s.ctx, "_25._tcp."+host)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+		// The records might exist, skip the server rather than risk a downgrade
+		return nil, errors.NewError(ErrSQDANELookupFailed).WithError(err).WithInfo("Remote host: %s", host)
+	}
+
+	// Unsigned records are worthless
+	if !authenticated || len(records) < 1 {
+		return nil, nil
+	}
+
+	return records, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/mailstore"
+)
+
+func TestLookupDANE(t *testing.T) {
+	record := dns.TLSA{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: []byte{1, 2, 3}}
+
+	resolver := dns.NewFakeResolver()
+	resolver.TLSA["_25._tcp.signed.test"] = []dns.TLSA{record}
+	resolver.Authenticated["_25._tcp.signed.test"] = true
+	resolver.TLSA["_25._tcp.unsigned.test"] = []dns.TLSA{record}
+
+	tests := []struct {
+		name string
+		host string
+		want []dns.TLSA
+	}{
+		{"signed records", "signed.test", []dns.TLSA{record}},
+		{"unsigned records are ignored", "unsigned.test", nil},
+		{"no records", "none.test", nil},
+	}
+
+	s := NewSendQueue("mx.test", mailstore.NewStore())
+	s.Resolver = resolver
+	for _, test := range tests {
+		records, err := s.lookupDANE(test.host)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(records, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, records, test.want)
+		}
+	}
+}
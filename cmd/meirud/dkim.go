@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/hamcha/meiru/lib/email"
+)
+
+// signOutbound adds a DKIM signature to mail leaving our server if the sender
+// domain has a signing key, otherwise the message is returned as is
+func (s *SendQueue) signOutbound(sender string, data *string) *string {
+	if sender == "" || !email.IsValidAddress(sender) {
+		return data
+	}
+
+	_, domain := email.SplitAddress(sender)
+	signer, ok := s.DKIMSigners[strings.ToLower(domain)]
+	if !ok {
+		return data
+	}
+
+	signed, err := signer.Sign(*data)
+	if err != nil {
+		log.Printf("[meirud] Could not DKIM sign mail from %s, sending it unsigned:\n\t%s\n", sender, err.Error())
+		return data
+	}
+	return &signed
+}
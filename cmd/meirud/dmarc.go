@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hamcha/meiru/lib/dmarc"
+)
+
+// reportLoop sends the collected DMARC aggregate reports every day at midnight UTC,
+// even to domains asking for a different interval (see dmarc.Reporter.Flush)
+func (s *SendQueue) reportLoop(ctx context.Context) {
+	for {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		timer := time.NewTimer(midnight.Sub(now))
+		select {
+		case <-timer.C:
+			s.sendDMARCReports()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// sendDMARCReports queues a report to every address that asked for one
+func (s *SendQueue) sendDMARCReports() {
+	sender := "noreply-dmarc@" + s.Hostname
+	for _, report := range s.DMARCReports.Flush(s.Hostname, sender) {
+		var recipients []string
+		for _, address := range report.Recipients {
+			// Addresses outside the policy domain must agree to get reports
+			if !dmarc.VerifyDestination(s.ctx, s.Resolver, report.Domain, address) {
+				log.Printf("[meirud] Not sending DMARC report for %s to %s: destination not authorized\r\n", report.Domain, address)
+				continue
+			}
+			recipients = append(recipients, address)
+		}
+		if len(recipients) < 1 {
+			continue
+		}
+
+		message, err := makeDMARCReport(s.Hostname, sender, recipients, report)
+		if err != nil {
+			log.Printf("[meirud] Could not create DMARC report for %s: %s\r\n", report.Domain, err.Error())
+			continue
+		}
+		log.Printf("[meirud] Sending DMARC report for %s to %d recipient(s)\r\n", report.Domain, len(recipients))
+		s.queueEnvelope(sender, recipients, &message, "")
+	}
+}
+
+// makeDMARCReport creates the mail for an aggregate report, with the XML
+// attached as a gzip file (RFC 7489 section 7.2.1)
+func makeDMARCReport(hostname, sender string, recipients []string, report dmarc.Report) (string, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(report.XML); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	filename := fmt.Sprintf("%s!%s!%d!%d.xml.gz", hostname, report.Domain, report.Begin.Unix(), report.End.Unix())
+	boundary := fmt.Sprintf("meiru-dmarc-%d", time.Now().UnixNano())
+
+	var out strings.Builder
+
+	// Headers
+	fmt.Fprintf(&out, "From: DMARC Reports <%s>\r\n", sender)
+	fmt.Fprintf(&out, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&out, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", report.Domain, hostname, report.ID)
+	fmt.Fprintf(&out, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&out, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&out, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(&out, "\r\n")
+
+	// Description
+	fmt.Fprintf(&out, "--%s\r\n", boundary)
+	fmt.Fprintf(&out, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&out, "This is a DMARC aggregate report from %s for %s,\r\n", hostname, report.Domain)
+	fmt.Fprintf(&out, "covering %s to %s.\r\n", report.Begin.UTC().Format(time.RFC1123), report.End.UTC().Format(time.RFC1123))
+
+	// Report
+	fmt.Fprintf(&out, "--%s\r\n", boundary)
+	fmt.Fprintf(&out, "Content-Type: application/gzip; name=\"%s\"\r\n", filename)
+	fmt.Fprintf(&out, "Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(&out, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", filename)
+	encoded := base64.StdEncoding.EncodeToString(compressed.Bytes())
+	for len(encoded) > 76 {
+		fmt.Fprintf(&out, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(&out, "%s\r\n", encoded)
+	fmt.Fprintf(&out, "--%s--\r\n", boundary)
+
+	return out.String(), nil
+}
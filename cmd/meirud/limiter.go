@@ -0,0 +1,75 @@
+package main
+
+import "sync"
+
+// deliveryLimiter caps how many remote connections are open at the same time,
+// both in total and for each destination domain
+type deliveryLimiter struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	active  int
+	domains map[string]int
+	waiting map[string][]sqOutboundMailData
+
+	maxTotal     int
+	maxPerDomain int
+}
+
+func newDeliveryLimiter(maxTotal, maxPerDomain int) *deliveryLimiter {
+	limiter := &deliveryLimiter{
+		domains:      make(map[string]int),
+		waiting:      make(map[string][]sqOutboundMailData),
+		maxTotal:     maxTotal,
+		maxPerDomain: maxPerDomain,
+	}
+	limiter.cond = sync.NewCond(&limiter.mutex)
+	return limiter
+}
+
+// acquire reserves a connection for the mail's domain, blocking while the total
+// limit is reached. If the domain is at its own limit the mail is parked
+// instead and false is returned, so the worker can move on to other domains.
+func (l *deliveryLimiter) acquire(mail sqOutboundMailData) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for {
+		if l.maxPerDomain > 0 && l.domains[mail.Domain] >= l.maxPerDomain {
+			l.waiting[mail.Domain] = append(l.waiting[mail.Domain], mail)
+			return false
+		}
+		if l.maxTotal <= 0 || l.active < l.maxTotal {
+			break
+		}
+		l.cond.Wait()
+	}
+
+	l.active++
+	l.domains[mail.Domain]++
+	return true
+}
+
+// release frees a connection for a domain. If there is parked mail for the
+// same domain, the connection is handed over to it and the mail is returned.
+func (l *deliveryLimiter) release(domain string) (sqOutboundMailData, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if queue := l.waiting[domain]; len(queue) > 0 {
+		next := queue[0]
+		if len(queue) > 1 {
+			l.waiting[domain] = queue[1:]
+		} else {
+			delete(l.waiting, domain)
+		}
+		return next, true
+	}
+
+	l.active--
+	l.domains[domain]--
+	if l.domains[domain] <= 0 {
+		delete(l.domains, domain)
+	}
+	l.cond.Broadcast()
+	return sqOutboundMailData{}, false
+}
@@ -3,17 +3,28 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/hamcha/meiru/lib/config"
+	"github.com/hamcha/meiru/lib/dkim"
+	"github.com/hamcha/meiru/lib/dmarc"
+	"github.com/hamcha/meiru/lib/dns"
 	"github.com/hamcha/meiru/lib/errors"
 	"github.com/hamcha/meiru/lib/imap"
 	"github.com/hamcha/meiru/lib/mailstore"
+	"github.com/hamcha/meiru/lib/mtasts"
 	"github.com/hamcha/meiru/lib/smtp"
 )
 
-var conf config.Config
+var (
+	conf  config.Config
+	store *mailstore.MailStore
+)
 
 func assert(err interface{}) {
 	switch e := err.(type) {
@@ -40,6 +51,16 @@ func assertCfg(err *errors.Error, cfg string) {
 }
 
 func main() {
+	// Admin subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "passwd":
+			os.Exit(runPasswd(os.Args[2:]))
+		case "check-config":
+			os.Exit(runCheckConfig(os.Args[2:]))
+		}
+	}
+
 	cfgpath := flag.String("config", "conf/meiru.conf", "Path to configuration file")
 	dump := flag.Bool("dump-cfg", false, "Dump parsed configuration and exit")
 	flag.Parse()
@@ -53,6 +74,8 @@ func main() {
 		return
 	}
 
+	validateConfig()
+
 	// Get required configuration values for the SMTP server
 
 	hostname, cfgerr := conf.QuerySingle("hostname 0")
@@ -62,13 +85,32 @@ func main() {
 
 	// Create mailstore for SMTP and IMAP servers
 
-	store := mailstore.NewStore()
-	store.LoadConfig(&conf)
+	store = mailstore.NewStore()
+	assert(store.LoadConfig(&conf))
 
 	queue, queuechan := startSendQueue(hostname, store)
-	_, smtpchan := startSMTPServer(bindsmtp, hostname, queue)
+	smtpd, smtpchan := startSMTPServer(bindsmtp, hostname, queue)
 	_, imapchan := startIMAPServer(bindimap, store)
 
+	// Stop deliveries in progress when asked to quit
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("[meirud] Received %s, shutting down\r\n", sig)
+		queue.Close()
+	}()
+
+	// Pick up new users, passwords and domains without restarting
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			log.Println("[meirud] Received SIGHUP, reloading configuration")
+			reloadConfig(*cfgpath, smtpd)
+		}
+	}()
+
 	select {
 	case err = <-smtpchan:
 		assert(err)
@@ -89,19 +131,25 @@ func startSMTPServer(bind, hostname string, queue *SendQueue) (*smtp.Server, <-c
 
 	// Setup auth handler
 	smtpd.OnAuthRequest = HandleLocalAuthRequest
+	smtpd.OnRecipientCheck = store.HasRecipient
 
 	// Setup sendmail handler
 	smtpd.OnReceivedMail = queue.QueueMail
 
+	// Check mail from other servers using the same resolver as the queue
+	smtpd.Resolver = queue.Resolver
+	loadInboundChecks(smtpd)
+
+	// Aggregate DMARC reports are sent by the queue
+	if smtpd.CheckDMARC {
+		smtpd.DMARCReports = queue.DMARCReports
+	}
+
 	// Check for custom max size
-	maxsize, err := conf.QuerySingle("max_size 0")
-	if err == nil {
-		maxsizeInt, err := parseByteSize(maxsize)
-		if err != nil {
-			log.Fatalf("The value of 'max_size' (%s) was not recognized as a valid size\r\n", maxsize)
-		} else {
-			smtpd.MaxSize = maxsizeInt
-		}
+	if maxsize, err := conf.QueryBytes("max_size 0"); err == nil {
+		smtpd.MaxSize = maxsize
+	} else if !config.IsMissing(err) {
+		assert(err)
 	}
 
 	bindStr := bind
@@ -133,33 +181,269 @@ func startIMAPServer(bind string, store *mailstore.MailStore) (*imap.Server, <-c
 }
 
 func loadSMTPOptions(smtpd *smtp.Server) {
-	domains, err := conf.Query("domain")
-	assert(err)
-	domainCount := len(domains)
+	// Local domains come from the mailstore, which already checked them
+	domains := store.DomainNames()
+	smtpd.SetLocalDomains(domains)
 
 	// Warn if there are no domains configured
-	if domainCount < 1 {
+	if len(domains) < 1 {
 		//TODO Check for open relay
 		log.Println("[meirud] No domain configured! Ignore this warning if this is the wanted behavior (open relay)")
 		return
 	}
 
-	smtpd.LocalDomains = make([]string, domainCount)
-	for i, domainProperty := range domains {
-		if len(domainProperty.Values) < 1 {
-			log.Fatalln("Defined domain block without domain name in configuration!")
+	log.Printf("[SMTPd] Loaded %d domain(s)\r\n", len(domains))
+}
+
+func loadInboundChecks(smtpd *smtp.Server) {
+	// DKIM signatures are verified unless explicitly disabled
+	smtpd.VerifyDKIM = true
+	if verify, err := conf.QueryBool("inbound dkim 0"); err == nil {
+		smtpd.VerifyDKIM = verify
+	} else if !config.IsMissing(err) {
+		assert(err)
+	}
+
+	// SPF results are recorded by default, "reject" also refuses failing senders
+	smtpd.CheckSPF = true
+	if str, err := conf.QuerySingle("inbound spf 0"); err == nil {
+		switch str {
+		case "on":
+		case "off":
+			smtpd.CheckSPF = false
+		case "reject":
+			smtpd.RejectSPFFail = true
+		default:
+			log.Fatalf("%s: The value of 'inbound.spf' (%s) is not valid (on, off, reject)\r\n", conf.Position("inbound spf"), str)
 		}
-		smtpd.LocalDomains[i] = domainProperty.Values[0]
 	}
 
-	log.Printf("[SMTPd] Loaded %d domain(s)\r\n", domainCount)
+	// DMARC policies are enforced by default, "monitor" only records results
+	smtpd.CheckDMARC = true
+	smtpd.EnforceDMARC = true
+	if str, err := conf.QuerySingle("inbound dmarc 0"); err == nil {
+		switch str {
+		case "on":
+		case "off":
+			smtpd.CheckDMARC = false
+			smtpd.EnforceDMARC = false
+		case "monitor":
+			smtpd.EnforceDMARC = false
+		default:
+			log.Fatalf("%s: The value of 'inbound.dmarc' (%s) is not valid (on, off, monitor)\r\n", conf.Position("inbound dmarc"), str)
+		}
+	}
 }
 
 func startSendQueue(hostname string, store *mailstore.MailStore) (*SendQueue, <-chan error) {
 	queue := NewSendQueue(hostname, store)
+	queue.Resolver = getResolver()
+	loadQueueOptions(queue)
+
+	// Collect DMARC results for aggregate reports unless disabled
+	reports, err := conf.QueryBool("inbound dmarc_reports 0")
+	if err != nil && !config.IsMissing(err) {
+		assert(err)
+	}
+	if err != nil || reports {
+		queue.DMARCReports = dmarc.NewReporter()
+	}
+
 	return queue, runServer(queue.Serve)
 }
 
+// queueOptions is the "queue:" block of the configuration
+type queueOptions struct {
+	Workers              int                 `config:"workers"`
+	MaxConnections       int                 `config:"max_connections"`
+	MaxDomainConnections int                 `config:"max_domain_connections"`
+	IdleTimeout          time.Duration       `config:"idle_timeout"`
+	RetryInterval        time.Duration       `config:"retry_interval"`
+	MaxRetryInterval     time.Duration       `config:"max_retry_interval"`
+	Lifetime             time.Duration       `config:"lifetime"`
+	DelayWarning         time.Duration       `config:"delay_warning"`
+	Timeouts             smtp.ClientTimeouts `config:"timeouts"`
+}
+
+// tlsOptions is the "tls:" block of the configuration
+type tlsOptions struct {
+	Outbound TLSPolicy            `config:"outbound"`
+	Policies map[string]TLSPolicy `config:"policy"`
+	MTASTS   bool                 `config:"mta-sts"`
+	DANE     bool                 `config:"dane"`
+}
+
+func loadQueueOptions(queue *SendQueue) {
+	options := queueOptions{
+		Workers:              queue.Workers,
+		MaxConnections:       queue.MaxConnections,
+		MaxDomainConnections: queue.MaxDomainConnections,
+		IdleTimeout:          queue.IdleTimeout,
+		RetryInterval:        queue.RetryInterval,
+		MaxRetryInterval:     queue.MaxRetryInterval,
+		Lifetime:             queue.Lifetime,
+		DelayWarning:         queue.DelayWarning,
+		Timeouts:             queue.Timeouts,
+	}
+	if err := conf.Decode("queue", &options); err != nil && !config.IsMissing(err) {
+		assert(err)
+	}
+
+	limits := map[string]int{
+		"workers":                options.Workers,
+		"max_connections":        options.MaxConnections,
+		"max_domain_connections": options.MaxDomainConnections,
+	}
+	for name, value := range limits {
+		if value < 0 {
+			log.Fatalf("%s: The value of 'queue.%s' (%d) cannot be negative\r\n", conf.Position("queue "+name), name, value)
+		}
+	}
+
+	queue.Workers = options.Workers
+	queue.MaxConnections = options.MaxConnections
+	queue.MaxDomainConnections = options.MaxDomainConnections
+	queue.IdleTimeout = options.IdleTimeout
+	queue.Timeouts = options.Timeouts
+
+	// Retries need some time to pass between attempts
+	retries := map[string]time.Duration{
+		"retry_interval":     options.RetryInterval,
+		"max_retry_interval": options.MaxRetryInterval,
+		"lifetime":           options.Lifetime,
+	}
+	for name, value := range retries {
+		if value <= 0 {
+			log.Fatalf("%s: The value of 'queue.%s' (%s) must be positive\r\n", conf.Position("queue "+name), name, value)
+		}
+	}
+	queue.RetryInterval = options.RetryInterval
+	queue.MaxRetryInterval = options.MaxRetryInterval
+	queue.Lifetime = options.Lifetime
+	queue.DelayWarning = options.DelayWarning
+
+	loadTLSPolicies(queue)
+	loadRelays(queue)
+	loadDKIMSigners(queue)
+
+	log.Printf("[meirud] Send queue: %d worker(s), max %d connection(s), max %d per domain\r\n", queue.Workers, queue.MaxConnections, queue.MaxDomainConnections)
+}
+
+func loadTLSPolicies(queue *SendQueue) {
+	// MTA-STS and DANE are enabled unless explicitly turned off
+	options := tlsOptions{
+		Outbound: queue.TLSPolicy,
+		MTASTS:   true,
+		DANE:     queue.DANE,
+	}
+	if err := conf.Decode("tls", &options); err != nil && !config.IsMissing(err) {
+		assert(err)
+	}
+
+	// Default policy for all destinations, with per destination overrides
+	queue.TLSPolicy = options.Outbound
+	for domain, policy := range options.Policies {
+		queue.DomainTLSPolicies[strings.ToLower(domain)] = policy
+	}
+
+	if options.MTASTS {
+		queue.MTASTS = mtasts.NewFetcher(queue.Resolver)
+	}
+	queue.DANE = options.DANE
+}
+
+func loadRelays(queue *SendQueue) {
+	relays, err := conf.Query("relay")
+	assert(err)
+
+	for _, property := range relays {
+		if len(property.Values) < 1 {
+			log.Fatalf("%s: Defined relay without address, use 'relay <host:port> [domain...]'\r\n", property.Position())
+		}
+
+		address := property.Values[0]
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "25")
+		}
+		relay := &Relay{
+			Address: address,
+			TLS:     DefaultRelayTLS(address),
+		}
+
+		// Optional settings
+		if property.Block != nil {
+			if user, err := conf.QuerySingleSub("auth 0", property.Block); err == nil {
+				relay.Username = user
+				relay.Password, _ = conf.QuerySingleSub("auth 1", property.Block)
+			}
+			relay.Mechanism, _ = conf.QuerySingleSub("mechanism 0", property.Block)
+			if mode, err := conf.QuerySingleSub("tls 0", property.Block); err == nil {
+				relay.TLS = RelayTLS(strings.ToLower(mode))
+				if relay.TLS != RelayTLSImplicit && relay.TLS != RelayTLSStartTLS && relay.TLS != RelayTLSNone {
+					log.Fatalf("%s: The TLS mode of relay '%s' (%s) is not valid (implicit, starttls, none)\r\n", property.Position(), address, mode)
+				}
+			}
+		}
+
+		// Without destination domains, the relay is used for everything
+		if len(property.Values) < 2 {
+			if queue.Relay != nil {
+				log.Fatalf("%s: More than one default relay defined, only one relay can be used for all domains\r\n", property.Position())
+			}
+			queue.Relay = relay
+			log.Printf("[meirud] Sending all outbound mail through %s\r\n", address)
+			continue
+		}
+		for _, domain := range property.Values[1:] {
+			queue.DomainRelays[strings.ToLower(domain)] = relay
+		}
+		log.Printf("[meirud] Sending mail for %s through %s\r\n", strings.Join(property.Values[1:], ", "), address)
+	}
+}
+
+func loadDKIMSigners(queue *SendQueue) {
+	domains, err := conf.Query("domain")
+	assert(err)
+
+	for _, domainProperty := range domains {
+		if len(domainProperty.Values) < 1 {
+			continue
+		}
+		domain := strings.ToLower(domainProperty.Values[0])
+
+		keys, err := conf.QuerySub("dkim", domainProperty.Block)
+		if err != nil || len(keys) < 1 {
+			continue
+		}
+		if len(keys[0].Values) < 2 {
+			log.Fatalf("%s: The DKIM key for '%s' is missing a selector or key file, use 'dkim <selector> <keyfile>'\r\n", keys[0].Position(), domain)
+		}
+
+		selector, keyfile := keys[0].Values[0], keys[0].Values[1]
+		key, kerr := dkim.LoadKey(keyfile)
+		if kerr != nil {
+			log.Fatalf("%s: Could not load the DKIM key for '%s':\r\n\t%s\r\n", keys[0].Position(), domain, kerr.Error())
+		}
+		queue.DKIMSigners[domain] = dkim.NewSigner(domain, selector, key)
+		log.Printf("[meirud] Signing mail from %s with DKIM selector '%s'\r\n", domain, selector)
+	}
+}
+
+func getResolver() dns.Resolver {
+	// Use the system resolver unless a specific one is configured
+	upstream, err := conf.QuerySingle("resolver 0")
+	if err != nil {
+		return dns.NewSystemResolver()
+	}
+
+	resolver, rerr := dns.NewUpstreamResolver(upstream)
+	if rerr != nil {
+		log.Fatalf("%s: The value of 'resolver' (%s) is not a valid DNS server address\r\n", conf.Position("resolver"), upstream)
+	}
+	log.Printf("[meirud] Using DNS resolver at %s\r\n", upstream)
+	return resolver
+}
+
 func runServer(fn func() error) <-chan error {
 	errch := make(chan error)
 	go func() {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hamcha/meiru/lib/errors"
+	"github.com/hamcha/meiru/lib/mtasts"
+)
+
+var (
+	ErrSQNoValidMX = errors.NewType(ErrSrcSendqueue, "No mail server allowed by the MTA-STS policy")
+)
+
+// applySTSPolicy restricts a delivery according to the MTA-STS policy of the
+// destination domain (RFC 8461), returning the hosts we are allowed to
+// deliver to, the TLS policy to use and a description of the policy result
+func (s *SendQueue) applySTSPolicy(domain string, hosts []string, tlsPolicy TLSPolicy) ([]string, TLSPolicy, string) {
+	if s.MTASTS == nil {
+		return hosts, tlsPolicy, ""
+	}
+
+	policy, err := s.MTASTS.Lookup(s.ctx, domain)
+	if err != nil {
+		log.Printf("[meirud] Error while fetching MTA-STS policy for %s:\n\t%s\n", domain, err.Error())
+	}
+	if policy == nil {
+		return hosts, tlsPolicy, "MTA-STS: no policy"
+	}
+
+	result := fmt.Sprintf("MTA-STS: policy %s, mode %s", policy.ID, policy.Mode)
+
+	switch policy.Mode {
+	case mtasts.ModeEnforce:
+		var allowed []string
+		for _, host := range hosts {
+			if policy.MatchMX(host) {
+				allowed = append(allowed, host)
+			} else {
+				log.Printf("[meirud] %s: skipping %s, not allowed by the policy\n", result, host)
+			}
+		}
+		// Enforced policies always require a valid certificate
+		return allowed, TLSRequired, result
+
+	case mtasts.ModeTesting:
+		// Only report failures, deliver as usual
+		for _, host := range hosts {
+			if !policy.MatchMX(host) {
+				log.Printf("[meirud] %s: %s would not be allowed by the policy\n", result, host)
+			}
+		}
+	}
+
+	return hosts, tlsPolicy, result
+}
+
+// withPolicyInfo adds the MTA-STS result to a delivery error so it ends up in
+// logs and bounces
+func withPolicyInfo(err error, info string) error {
+	if e, ok := err.(*errors.Error); ok && e != nil && info != "" {
+		return e.WithInfo("%s", info)
+	}
+	return err
+}
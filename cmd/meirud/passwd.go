@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/hamcha/meiru/lib/config"
+	"github.com/hamcha/meiru/lib/email"
+)
+
+// runPasswd implements "meirud passwd [options] user@domain", which hashes
+// a password for a user and optionally writes it to the configuration
+func runPasswd(args []string) int {
+	flags := flag.NewFlagSet("passwd", flag.ExitOnError)
+	cfgpath := flags.String("config", "conf/meiru.conf", "Path to configuration file")
+	scheme := flags.String("scheme", DefaultPasswordScheme, "Password scheme (argon2id, bcrypt, scrypt, sha512-crypt)")
+	write := flags.Bool("write", false, "Update the user's password in the configuration file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s passwd [options] user@domain\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || !email.IsValidAddress(flags.Arg(0)) {
+		flags.Usage()
+		return 2
+	}
+	address := flags.Arg(0)
+
+	password, err := readNewPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read password: %s\n", err.Error())
+		return 1
+	}
+
+	values, err := hashPassword(strings.ToLower(*scheme), password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not hash password: %s\n", err.Error())
+		return 1
+	}
+
+	if !*write {
+		fmt.Printf("password %s\n", strings.Join(values, " "))
+		return 0
+	}
+
+	if err := writePassword(*cfgpath, address, values); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not update %s: %s\n", *cfgpath, err.Error())
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Updated password for %s in %s, send SIGHUP to meirud to apply it\n", address, *cfgpath)
+	return 0
+}
+
+// readNewPassword asks for a password twice without echoing it, or reads
+// a single line when the input is not a terminal
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(first) != string(second) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	if len(first) < 1 {
+		return "", fmt.Errorf("empty password")
+	}
+	return string(first), nil
+}
+
+// writePassword sets the password of a user in the configuration file,
+// adding the user to its domain block if it's not there yet.
+// Configurations where the domain, user or password are inside @if/@else
+// blocks are left alone, since we can't tell which one is in use.
+func writePassword(path, address string, values []string) error {
+	doc, err := config.LoadDocument(path)
+	if err != nil {
+		return err
+	}
+
+	name, host := email.SplitAddress(address)
+	if err := checkConditional(doc.Root, "domain", host); err != nil {
+		return err
+	}
+	domain := doc.Root.Find("domain", host)
+	if domain == nil {
+		return fmt.Errorf("domain '%s' is not configured", host)
+	}
+
+	if err := checkConditional(domain, "user", name); err != nil {
+		return err
+	}
+	user := domain.Find("user", name)
+	if user == nil {
+		user = domain.AddBlock("user", name)
+	} else if err := checkConditional(user, "password"); err != nil {
+		return err
+	}
+	user.Set("password", values...)
+
+	return doc.Save()
+}
+
+// checkConditional returns an error if a property is defined in a conditional
+// block, where changing or adding it could leave it duplicated
+func checkConditional(node *config.Node, key string, values ...string) error {
+	found := node.FindConditional(key, values...)
+	if found == nil {
+		return nil
+	}
+	return fmt.Errorf("'%s' is inside an @if/@else block (%s:%d), edit it by hand", strings.Join(append([]string{key}, values...), " "), found.File(), found.Line())
+}
@@ -1,28 +1,278 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
+	"log"
 	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/hamcha/meiru/lib/config"
 )
 
-func checkPassword(passwordData []string, otherPassword string) bool {
-	pwdType := "plain"
-	originalPassword := ""
+// Supported password schemes, as written in the configuration
+const (
+	SchemePlain       = "plain"
+	SchemeSHA256      = "sha256"
+	SchemeBcrypt      = "bcrypt"
+	SchemeArgon2id    = "argon2id"
+	SchemeScrypt      = "scrypt"
+	SchemeSHA512Crypt = "sha512-crypt"
+)
+
+// Dovecot style "{SCHEME}hash" prefixes, for importing existing users
+var dovecotSchemes = map[string]string{
+	"{PLAIN}":        SchemePlain,
+	"{BLF-CRYPT}":    SchemeBcrypt,
+	"{ARGON2ID}":     SchemeArgon2id,
+	"{SHA512-CRYPT}": SchemeSHA512Crypt,
+}
+
+// Prefixes of crypt style hashes, which can be written without a scheme
+var cryptSchemes = []struct {
+	prefix string
+	scheme string
+}{
+	{sha512CryptPrefix, SchemeSHA512Crypt},
+	{"$2a$", SchemeBcrypt},
+	{"$2b$", SchemeBcrypt},
+	{"$2y$", SchemeBcrypt},
+	{"$argon2id$", SchemeArgon2id},
+	{"$scrypt$", SchemeScrypt},
+}
+
+// schemeUnknown is returned for values that look like hashes of a scheme we
+// don't support, so they're never mistaken for plain text passwords
+const schemeUnknown = "unknown"
+
+// parsePassword gets the scheme and hash out of a password property, which
+// is either "password <scheme> <hash>" or "password <plain|{SCHEME}hash|$id$hash>".
+// Single values starting with "{" or "$" are always taken as hashes, use
+// "password plain <value>" for plain text passwords that start that way.
+func parsePassword(passwordData []string) (string, string) {
 	if len(passwordData) > 1 {
-		pwdType = strings.ToLower(passwordData[0])
-		originalPassword = passwordData[1]
-	} else {
-		originalPassword = passwordData[0]
+		return strings.ToLower(passwordData[0]), passwordData[1]
+	}
+
+	value := passwordData[0]
+	if strings.HasPrefix(value, "{") {
+		end := strings.IndexByte(value, '}')
+		if end > 0 {
+			if scheme, ok := dovecotSchemes[strings.ToUpper(value[:end+1])]; ok {
+				return scheme, value[end+1:]
+			}
+		}
+		return schemeUnknown, value
+	}
+	if strings.HasPrefix(value, "$") {
+		for _, crypt := range cryptSchemes {
+			if strings.HasPrefix(value, crypt.prefix) {
+				return crypt.scheme, value
+			}
+		}
+		return schemeUnknown, value
+	}
+	return SchemePlain, value
+}
+
+// isWeakScheme reports schemes that store the password as is or unsalted
+func isWeakScheme(scheme string) bool {
+	return scheme == SchemePlain || scheme == SchemeSHA256
+}
+
+// plainPasswordsAllowed checks if plain and unsalted passwords are accepted,
+// which they only are when allow_plain_passwords is explicitly on
+func plainPasswordsAllowed(cfg config.Config) bool {
+	allowed, err := cfg.QueryBool("allow_plain_passwords 0")
+	if err != nil {
+		if !config.IsMissing(err) {
+			log.Printf("[meirud] Refusing plain text passwords:\n\t%s\r\n", err.Error())
+		}
+		return false
+	}
+	return allowed
+}
+
+// passwordIssues warns about passwords that will be refused or that are only
+// accepted because allow_plain_passwords is on
+func passwordIssues(cfg config.Config) []config.Issue {
+	passwords, err := cfg.Query("domain user password")
+	if err != nil {
+		return nil
+	}
+
+	var issues []config.Issue
+	allowed := plainPasswordsAllowed(cfg)
+	for _, password := range passwords {
+		if len(password.Values) < 1 {
+			continue
+		}
+		scheme, _ := parsePassword(password.Values)
+		switch {
+		case scheme == schemeUnknown:
+			issues = append(issues, config.Issue{Property: password, Warning: true, Message: "unknown password scheme, logins will be refused"})
+		case isWeakScheme(scheme) && allowed:
+			issues = append(issues, config.Issue{Property: password, Warning: true, Message: fmt.Sprintf("%s password accepted because allow_plain_passwords is on, use a salted scheme instead", scheme)})
+		case isWeakScheme(scheme):
+			issues = append(issues, config.Issue{Property: password, Warning: true, Message: fmt.Sprintf("%s password, logins will be refused unless allow_plain_passwords is on", scheme)})
+		}
+	}
+	return issues
+}
+
+func checkPassword(passwordData []string, otherPassword string) bool {
+	pwdType, originalPassword := parsePassword(passwordData)
+
+	if isWeakScheme(pwdType) && !plainPasswordsAllowed(currentConfig()) {
+		log.Printf("[meirud] Refusing login against a %s password, use a salted scheme instead\r\n", pwdType)
+		return false
 	}
 
 	switch pwdType {
-	case "plain":
-		return originalPassword == otherPassword
-	case "sha256":
+	case SchemePlain:
+		// Compare digests so the comparison time doesn't depend on the length
+		original := sha256.Sum256([]byte(originalPassword))
+		other := sha256.Sum256([]byte(otherPassword))
+		return subtle.ConstantTimeCompare(original[:], other[:]) == 1
+	case SchemeSHA256:
 		shabytes := sha256.Sum256([]byte(otherPassword))
-		return originalPassword == hex.EncodeToString(shabytes[:])
+		other := hex.EncodeToString(shabytes[:])
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(originalPassword)), []byte(other)) == 1
+	case SchemeBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(originalPassword), []byte(otherPassword)) == nil
+	case SchemeArgon2id:
+		return checkArgon2id(originalPassword, otherPassword)
+	case SchemeScrypt:
+		return checkScrypt(originalPassword, otherPassword)
+	case SchemeSHA512Crypt:
+		return checkSHA512Crypt(originalPassword, otherPassword)
 	}
 
+	log.Printf("[meirud] Unknown password scheme '%s'\r\n", pwdType)
 	return false
 }
+
+// checkArgon2id checks a password against a PHC string
+// ("$argon2id$v=19$m=65536,t=3,p=4$salt$hash")
+func checkArgon2id(hashed, password string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != "v=19" {
+		return false
+	}
+
+	// IDKey panics on parameters out of range
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil ||
+		time < 1 || threads < 1 || memory < 8*uint32(threads) {
+		return false
+	}
+	salt, key, ok := decodeSaltAndKey(parts[4], parts[5])
+	if !ok || len(salt) < 1 {
+		return false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// checkScrypt checks a password against a "$scrypt$ln=15,r=8,p=1$salt$hash"
+// string, where N is 2^ln
+func checkScrypt(hashed, password string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return false
+	}
+
+	var logN, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil || logN < 1 || logN > 31 {
+		return false
+	}
+	salt, key, ok := decodeSaltAndKey(parts[3], parts[4])
+	if !ok {
+		return false
+	}
+
+	computed, err := scrypt.Key([]byte(password), salt, 1<<uint(logN), r, p, len(key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// decodeSaltAndKey decodes the base64 salt and hash of a PHC-like string
+func decodeSaltAndKey(salt, key string) ([]byte, []byte, bool) {
+	saltBytes, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(salt, "="))
+	if err != nil {
+		return nil, nil, false
+	}
+	keyBytes, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(key, "="))
+	if err != nil || len(keyBytes) < 1 {
+		return nil, nil, false
+	}
+	return saltBytes, keyBytes, true
+}
+
+// Parameters used for new hashes
+const (
+	DefaultPasswordScheme = SchemeArgon2id
+
+	bcryptCost     = 12
+	argon2Memory   = 64 * 1024
+	argon2Time     = 3
+	argon2Threads  = 4
+	scryptLogN     = 15
+	scryptR        = 8
+	scryptP        = 1
+	passwordKeyLen = 32
+	passwordSalt   = 16
+)
+
+// hashPassword hashes a password with a salted scheme, returning the
+// values for a "password" property
+func hashPassword(scheme, password string) ([]string, error) {
+	salt := make([]byte, passwordSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	var hashed string
+	switch scheme {
+	case SchemeBcrypt:
+		out, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		if err != nil {
+			return nil, err
+		}
+		hashed = string(out)
+	case SchemeArgon2id:
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, passwordKeyLen)
+		hashed = fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	case SchemeScrypt:
+		key, err := scrypt.Key([]byte(password), salt, 1<<scryptLogN, scryptR, scryptP, passwordKeyLen)
+		if err != nil {
+			return nil, err
+		}
+		hashed = fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", scryptLogN, scryptR, scryptP,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	case SchemeSHA512Crypt:
+		// The salt uses the same alphabet as the hash
+		saltChars := make([]byte, sha512CryptMaxSalt)
+		for i := range saltChars {
+			saltChars[i] = cryptAlphabet[int(salt[i%len(salt)])%len(cryptAlphabet)]
+		}
+		hashed, _ = sha512Crypt(password, sha512CryptPrefix+string(saltChars))
+	default:
+		return nil, fmt.Errorf("cannot create %s passwords, use one of: %s, %s, %s, %s", scheme,
+			SchemeArgon2id, SchemeBcrypt, SchemeScrypt, SchemeSHA512Crypt)
+	}
+
+	return []string{scheme, hashed}, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/hamcha/meiru/lib/config"
+)
+
+// Test vector from Ulrich Drepper's SHA-crypt specification
+const (
+	drepperPassword = "Hello world!"
+	drepperHash     = "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+)
+
+func TestParsePassword(t *testing.T) {
+	tests := []struct {
+		values []string
+		scheme string
+		hash   string
+	}{
+		{[]string{"plain", "secret"}, SchemePlain, "secret"},
+		{[]string{"SHA512-CRYPT", drepperHash}, SchemeSHA512Crypt, drepperHash},
+		{[]string{"secret"}, SchemePlain, "secret"},
+		{[]string{"{PLAIN}secret"}, SchemePlain, "secret"},
+		{[]string{"{SHA512-CRYPT}" + drepperHash}, SchemeSHA512Crypt, drepperHash},
+		{[]string{drepperHash}, SchemeSHA512Crypt, drepperHash},
+		{[]string{"$2a$10$abc"}, SchemeBcrypt, "$2a$10$abc"},
+		{[]string{"$2b$10$abc"}, SchemeBcrypt, "$2b$10$abc"},
+		{[]string{"$2y$10$abc"}, SchemeBcrypt, "$2y$10$abc"},
+		{[]string{"$argon2id$v=19$abc"}, SchemeArgon2id, "$argon2id$v=19$abc"},
+		{[]string{"$scrypt$ln=15$abc"}, SchemeScrypt, "$scrypt$ln=15$abc"},
+		{[]string{"$1$salt$md5"}, schemeUnknown, "$1$salt$md5"},
+		{[]string{"{SSHA}abc"}, schemeUnknown, "{SSHA}abc"},
+	}
+
+	for _, test := range tests {
+		scheme, hash := parsePassword(test.values)
+		if scheme != test.scheme || hash != test.hash {
+			t.Errorf("%q: got (%s, %s), want (%s, %s)", test.values, scheme, hash, test.scheme, test.hash)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	conf = config.Config{}
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not generate bcrypt hash: %s", err.Error())
+	}
+	argon2Values, err := hashPassword(SchemeArgon2id, "secret")
+	if err != nil {
+		t.Fatalf("could not generate argon2id hash: %s", err.Error())
+	}
+	scryptValues, err := hashPassword(SchemeScrypt, "secret")
+	if err != nil {
+		t.Fatalf("could not generate scrypt hash: %s", err.Error())
+	}
+
+	tests := []struct {
+		name     string
+		values   []string
+		password string
+		want     bool
+	}{
+		{"bare sha512-crypt", []string{drepperHash}, drepperPassword, true},
+		{"bare sha512-crypt, wrong password", []string{drepperHash}, "hello world!", false},
+		{"bare sha512-crypt, hash as password", []string{drepperHash}, drepperHash, false},
+		{"dovecot sha512-crypt", []string{"{SHA512-CRYPT}" + drepperHash}, drepperPassword, true},
+		{"bare bcrypt $2y$", []string{strings.Replace(string(bcryptHash), "$2a$", "$2y$", 1)}, "secret", true},
+		{"bare bcrypt, hash as password", []string{string(bcryptHash)}, string(bcryptHash), false},
+		{"bare argon2id", argon2Values[1:], "secret", true},
+		{"bare argon2id, wrong password", argon2Values[1:], "Secret", false},
+		{"bare scrypt", scryptValues[1:], "secret", true},
+		{"unknown crypt scheme", []string{"$1$salt$hash"}, "$1$salt$hash", false},
+		{"plain, not allowed by default", []string{"plain", "secret"}, "secret", false},
+		{"argon2id without threads", []string{"$argon2id$v=19$m=65536,t=3,p=0$c2FsdHNhbHQ$a2V5a2V5"}, "secret", false},
+		{"argon2id without passes", []string{"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHQ$a2V5a2V5"}, "secret", false},
+		{"argon2id with too little memory", []string{"$argon2id$v=19$m=31,t=3,p=4$c2FsdHNhbHQ$a2V5a2V5"}, "secret", false},
+		{"argon2id without salt", []string{"$argon2id$v=19$m=65536,t=3,p=4$$a2V5a2V5"}, "secret", false},
+	}
+
+	for _, test := range tests {
+		if got := checkPassword(test.values, test.password); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPlainPasswordsAllowed(t *testing.T) {
+	tests := []struct {
+		config string
+		want   bool
+	}{
+		{"", false},
+		{"allow_plain_passwords on", true},
+		{"allow_plain_passwords off", false},
+		{"allow_plain_passwords maybe", false},
+	}
+
+	for _, test := range tests {
+		var block config.Block
+		if test.config != "" {
+			fields := strings.Fields(test.config)
+			block = config.Block{{Key: fields[0], Values: fields[1:]}}
+		}
+		if got := plainPasswordsAllowed(config.Config{Data: block}); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.config, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/hamcha/meiru/lib/errors"
+	"github.com/hamcha/meiru/lib/smtp"
+)
+
+var (
+	ErrSQRelayAuthFailed = errors.NewType(ErrSrcSendqueue, "Cannot authenticate with relay")
+)
+
+// RelayTLS is how the connection to a relay is encrypted
+type RelayTLS string
+
+const (
+	// RelayTLSImplicit starts TLS right after connecting (port 465)
+	RelayTLSImplicit RelayTLS = "implicit"
+	// RelayTLSStartTLS requires STARTTLS (port 587)
+	RelayTLSStartTLS RelayTLS = "starttls"
+	// RelayTLSNone talks in plaintext, only meant for relays on trusted networks
+	RelayTLSNone RelayTLS = "none"
+)
+
+// Relay is a smarthost that takes care of delivering our outbound mail
+type Relay struct {
+	Address   string
+	TLS       RelayTLS
+	Username  string
+	Password  string
+	Mechanism string
+}
+
+// DefaultRelayTLS guesses how to encrypt a connection to a relay from its port
+func DefaultRelayTLS(address string) RelayTLS {
+	_, port, _ := net.SplitHostPort(address)
+	if port == "465" {
+		return RelayTLSImplicit
+	}
+	return RelayTLSStartTLS
+}
+
+// relayFor returns the relay to use for a destination domain, or nil if mail
+// should be delivered directly
+func (s *SendQueue) relayFor(domain string) *Relay {
+	if relay, ok := s.DomainRelays[strings.ToLower(domain)]; ok {
+		return relay
+	}
+	return s.Relay
+}
+
+// connectRelay opens an authenticated connection to a relay
+func (s *SendQueue) connectRelay(relay *Relay) (*smtp.Client, error) {
+	host, _, _ := net.SplitHostPort(relay.Address)
+	config := &tls.Config{ServerName: host}
+
+	var client *smtp.Client
+	var err error
+	if relay.TLS == RelayTLSImplicit {
+		client, err = smtp.NewClientTLS(s.ctx, relay.Address, config, s.Timeouts)
+	} else {
+		client, err = smtp.NewClientWithTimeouts(s.ctx, relay.Address, s.Timeouts)
+	}
+	if err != nil {
+		return nil, errors.NewError(ErrSQCannotConnectToRemote).WithError(err).WithInfo("Relay: %s", relay.Address)
+	}
+	if err = client.Greet(s.ctx, s.Hostname); err != nil {
+		client.Close(s.ctx)
+		return nil, errors.NewError(ErrSQCommunicationErrorRemote).WithError(err).WithInfo("Relay: %s", relay.Address)
+	}
+
+	if relay.TLS == RelayTLSStartTLS {
+		if err = client.StartTLS(s.ctx, config); err != nil {
+			client.Close(s.ctx)
+			return nil, errors.NewError(ErrSQTLSRequired).WithError(err).WithInfo("Relay: %s", relay.Address)
+		}
+		if err = client.Greet(s.ctx, s.Hostname); err != nil {
+			client.Close(s.ctx)
+			return nil, errors.NewError(ErrSQCommunicationErrorRemote).WithError(err).WithInfo("Relay: %s", relay.Address)
+		}
+	}
+
+	if relay.Username != "" {
+		if err = client.Auth(s.ctx, relay.Mechanism, relay.Username, relay.Password); err != nil {
+			client.Close(s.ctx)
+			return nil, errors.NewError(ErrSQRelayAuthFailed).WithError(err).WithInfo("Relay: %s", relay.Address)
+		}
+	}
+
+	return client, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hamcha/meiru/lib/config"
+	"github.com/hamcha/meiru/lib/smtp"
+)
+
+// confLock guards conf once the servers are running
+var confLock sync.RWMutex
+
+// currentConfig returns the configuration in use, it's safe to call while a
+// reload is in progress
+func currentConfig() config.Config {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return conf
+}
+
+// reloadConfig loads the configuration file again and applies what can be
+// changed while running: users, passwords and local domains. Everything else
+// (listeners, queue, TLS, relays, inbound checks) needs a restart.
+// If the new configuration has errors, the current one is kept.
+func reloadConfig(path string, smtpd *smtp.Server) {
+	newConf, err := config.LoadConfig(path)
+	if err != nil {
+		log.Printf("[meirud] Could not reload configuration, keeping the current one:\n\t%s\r\n", err.Error())
+		return
+	}
+
+	issues := append(newConf.Validate(configSchema), passwordIssues(newConf)...)
+	for _, issue := range issues {
+		log.Printf("[meirud] %s\r\n", issue.String())
+	}
+	if config.HasErrors(issues) {
+		log.Println("[meirud] The new configuration has errors, keeping the current one (see 'meirud check-config')")
+		return
+	}
+
+	// The mailstore only swaps its index if the new one could be built
+	if err := store.LoadConfig(&newConf); err != nil {
+		log.Printf("[meirud] Could not reload configuration, keeping the current one:\n\t%s\r\n", err.Error())
+		return
+	}
+
+	confLock.Lock()
+	conf = newConf
+	confLock.Unlock()
+
+	smtpd.SetLocalDomains(store.DomainNames())
+
+	log.Printf("[meirud] Configuration reloaded from %s\r\n", path)
+}
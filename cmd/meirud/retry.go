@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/errors"
+	"github.com/hamcha/meiru/lib/smtp"
+)
+
+var (
+	ErrSQGaveUp = errors.NewType(ErrSrcSendqueue, "Gave up delivering mail after retrying")
+)
+
+// isPermanentFailure tells failures that retrying can't fix (5xx replies,
+// domains that don't exist or don't accept mail) from temporary ones
+func isPermanentFailure(err error) bool {
+	if smtp.IsPermanentError(err) {
+		return true
+	}
+	for err != nil {
+		if dns.IsNotFound(err) {
+			return true
+		}
+		e, ok := err.(*errors.Error)
+		if !ok {
+			return false
+		}
+		if e.Type == ErrSQNullMX {
+			return true
+		}
+		err = e.SubError
+	}
+	return false
+}
+
+// deliveryFailed bounces mail that can't be delivered and schedules another
+// attempt for temporary failures
+func (s *SendQueue) deliveryFailed(data sqOutboundMailData, err error) {
+	if isPermanentFailure(err) {
+		s.HandleDeliveryError(data.Sender, data.Recipients, data.Data, err)
+		return
+	}
+	s.retryLater(data, data.Recipients, err)
+}
+
+// handleRejected deals with the recipients refused by a server, refusals
+// for good are bounced and the others are retried later
+func (s *SendQueue) handleRejected(data sqOutboundMailData, rejected map[string]error, where string, policyInfo string) {
+	var deferred []string
+	var deferErr error
+	for _, recipient := range data.Recipients {
+		rcpterr, ok := rejected[recipient]
+		if !ok {
+			continue
+		}
+		err := withPolicyInfo(errors.NewError(ErrSQRecipientRejected).WithError(rcpterr).WithInfo("%s", where), policyInfo)
+		if !isPermanentFailure(rcpterr) {
+			deferred = append(deferred, recipient)
+			deferErr = err
+			continue
+		}
+		log.Printf("Error while delivering mail to %s:\n\t%s\n", recipient, err.Error())
+		s.HandleDeliveryError(data.Sender, []string{recipient}, data.Data, err)
+	}
+
+	if len(deferred) > 0 {
+		s.retryLater(data, deferred, deferErr)
+	}
+}
+
+// anyPermanent returns true if any of the recipient refusals is final
+func anyPermanent(rejected map[string]error) bool {
+	for _, err := range rejected {
+		if isPermanentFailure(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryLater puts mail back in the queue after a delay that doubles with
+// every attempt. Mail still undelivered after the queue lifetime is bounced,
+// the sender is warned once when it's been delayed for a while.
+// Retries are only kept in memory, like the rest of the queue.
+func (s *SendQueue) retryLater(data sqOutboundMailData, recipients []string, err error) {
+	// Deliveries aborted because we are shutting down are not the sender's fault
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	data.Recipients = recipients
+	data.Attempts++
+
+	age := time.Since(data.Queued)
+	if age >= s.Lifetime {
+		gaveup := errors.NewError(ErrSQGaveUp).WithError(err).WithInfo("Attempts: %d over %s", data.Attempts, age.Round(time.Minute))
+		log.Printf("Error while delivering mail to %s:\n\t%s\n", strings.Join(recipients, ", "), gaveup.Error())
+		s.HandleDeliveryError(data.Sender, recipients, data.Data, gaveup)
+		return
+	}
+
+	if s.DelayWarning > 0 && age >= s.DelayWarning && !data.DelayNotified {
+		data.DelayNotified = true
+		s.notifyDelay(data, err)
+	}
+
+	delay := s.retryDelay(data.Attempts)
+	log.Printf("[meirud] Delivery to %s deferred, retrying in %s:\n\t%s\n", strings.Join(recipients, ", "), delay, err.Error())
+	time.AfterFunc(delay, func() {
+		s.requeue(data)
+	})
+}
+
+// retryDelay returns how long to wait before the next attempt
+func (s *SendQueue) retryDelay(attempts int) time.Duration {
+	delay := s.RetryInterval
+	for i := 1; i < attempts && delay < s.MaxRetryInterval; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxRetryInterval {
+		delay = s.MaxRetryInterval
+	}
+	return delay
+}
+
+// requeue sends mail back to the delivery workers, looking up its mail
+// servers again since they might have changed
+func (s *SendQueue) requeue(data sqOutboundMailData) {
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	if err := s.resolveOutbound(&data); err != nil {
+		log.Printf("Error while resolving mail server for %s:\n\t%s\n", data.Domain, err.Error())
+		s.deliveryFailed(data, err)
+		return
+	}
+
+	select {
+	case s.outbound <- data:
+	case <-s.ctx.Done():
+	}
+}
+
+// notifyDelay tells the sender that a message is late but still being retried
+func (s *SendQueue) notifyDelay(data sqOutboundMailData, err error) {
+	// Never send notices about bounces (null sender)
+	if data.Sender == "" {
+		return
+	}
+
+	notice := makeDelayNotice(s.Hostname, data.Sender, data.Recipients, data.Data, err, data.Queued.Add(s.Lifetime))
+	s.queueEnvelope("", []string{data.Sender}, &notice, "")
+}
@@ -0,0 +1,78 @@
+package main
+
+import "github.com/hamcha/meiru/lib/config"
+
+var (
+	onOff       = config.Enum("on", "off")
+	tlsPolicies = config.Enum(TLSNone.String(), TLSOpportunistic.String(), TLSRequired.String())
+)
+
+var timeoutsSchema = config.Schema{
+	{Key: "connect", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+	{Key: "greeting", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+	{Key: "command", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+	{Key: "mail", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+	{Key: "rcpt", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+	{Key: "data_init", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+	{Key: "data_block", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+	{Key: "data_end", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+	{Key: "quit", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+}
+
+var userSchema = config.Schema{
+	{Key: "password", Values: []config.Value{config.String, config.String}, Required: 1, Unique: true},
+	{Key: "box", Values: []config.Value{config.Path}, Required: 1, Unique: true},
+}
+
+// configSchema describes every property meirud understands
+var configSchema = config.Schema{
+	{Key: "hostname", Values: []config.Value{config.String}, Required: 1, Mandatory: true, Unique: true},
+	{Key: "bind", Values: []config.Value{config.Address}, Required: 1, Unique: true},
+	{Key: "bind.smtp", Values: []config.Value{config.Address}, Required: 1, Unique: true},
+	{Key: "bind.imap", Values: []config.Value{config.Address}, Required: 1, Unique: true},
+	{Key: "max_size", Values: []config.Value{config.Size}, Required: 1, Unique: true},
+	{Key: "resolver", Values: []config.Value{config.Address}, Required: 1, Unique: true},
+	{Key: "allow_plain_passwords", Values: []config.Value{onOff}, Required: 1, Unique: true},
+
+	{Key: "queue", Unique: true, Block: config.Schema{
+		{Key: "workers", Values: []config.Value{config.Int}, Required: 1, Unique: true},
+		{Key: "max_connections", Values: []config.Value{config.Int}, Required: 1, Unique: true},
+		{Key: "max_domain_connections", Values: []config.Value{config.Int}, Required: 1, Unique: true},
+		{Key: "idle_timeout", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+		{Key: "retry_interval", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+		{Key: "max_retry_interval", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+		{Key: "lifetime", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+		{Key: "delay_warning", Values: []config.Value{config.Duration}, Required: 1, Unique: true},
+		{Key: "timeouts", Unique: true, Block: timeoutsSchema},
+	}},
+
+	{Key: "tls", Unique: true, Block: config.Schema{
+		{Key: "outbound", Values: []config.Value{tlsPolicies}, Required: 1, Unique: true},
+		{Key: "policy", Values: []config.Value{config.String, tlsPolicies}, Required: 2},
+		{Key: "mta-sts", Values: []config.Value{onOff}, Required: 1, Unique: true},
+		{Key: "dane", Values: []config.Value{onOff}, Required: 1, Unique: true},
+	}},
+
+	{Key: "inbound", Unique: true, Block: config.Schema{
+		{Key: "dkim", Values: []config.Value{onOff}, Required: 1, Unique: true},
+		{Key: "spf", Values: []config.Value{config.Enum("on", "off", "reject")}, Required: 1, Unique: true},
+		{Key: "dmarc", Values: []config.Value{config.Enum("on", "off", "monitor")}, Required: 1, Unique: true},
+		{Key: "dmarc_reports", Values: []config.Value{onOff}, Required: 1, Unique: true},
+	}},
+
+	{Key: "relay", Values: []config.Value{config.Address, config.String}, Required: 1, Variadic: true, Block: config.Schema{
+		{Key: "auth", Values: []config.Value{config.String, config.String}, Required: 2, Unique: true},
+		{Key: "mechanism", Values: []config.Value{config.Enum("plain", "login", "cram-md5")}, Required: 1, Unique: true},
+		{Key: "tls", Values: []config.Value{config.Enum(string(RelayTLSImplicit), string(RelayTLSStartTLS), string(RelayTLSNone))}, Required: 1, Unique: true},
+	}},
+
+	{Key: "default", Unique: true, Block: config.Schema{
+		{Key: "box", Values: []config.Value{config.Path}, Required: 1, Unique: true},
+	}},
+
+	{Key: "domain", Values: []config.Value{config.String}, Required: 1, Block: config.Schema{
+		{Key: "dkim", Values: []config.Value{config.String, config.Path}, Required: 2, Unique: true},
+		{Key: "catch-all", Values: []config.Value{config.String}, Required: 1, Unique: true},
+		{Key: "user", Values: []config.Value{config.String}, Required: 1, Block: userSchema},
+	}},
+}
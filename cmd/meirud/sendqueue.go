@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/hamcha/meiru/lib/dkim"
+	"github.com/hamcha/meiru/lib/dmarc"
+	"github.com/hamcha/meiru/lib/dns"
 	"github.com/hamcha/meiru/lib/email"
 	"github.com/hamcha/meiru/lib/errors"
 	"github.com/hamcha/meiru/lib/mailstore"
+	"github.com/hamcha/meiru/lib/mtasts"
 	"github.com/hamcha/meiru/lib/smtp"
 )
 
@@ -17,71 +27,208 @@ var (
 	ErrSQCannotResolveDomain      = errors.NewType(ErrSrcSendqueue, "Cannot resolve remote mail server")
 	ErrSQCannotConnectToRemote    = errors.NewType(ErrSrcSendqueue, "Cannot connect to remote mail server")
 	ErrSQCommunicationErrorRemote = errors.NewType(ErrSrcSendqueue, "Communication error while talking to remote mail server")
+	ErrSQNullMX                   = errors.NewType(ErrSrcSendqueue, "Remote domain does not accept mail (null MX)")
+	ErrSQRecipientRejected        = errors.NewType(ErrSrcSendqueue, "Recipient rejected by remote mail server")
+	ErrSQAllRecipientsRejected    = errors.NewType(ErrSrcSendqueue, "All recipients rejected by remote mail server")
+)
+
+const (
+	DefaultQueueWorkers              = 4
+	DefaultQueueMaxConnections       = 20
+	DefaultQueueMaxDomainConnections = 2
+	DefaultQueueIdleTimeout          = 30 * time.Second
+
+	// RFC 5321 section 4.5.4.1 suggests giving up after 4-5 days
+	DefaultQueueRetryInterval    = 5 * time.Minute
+	DefaultQueueMaxRetryInterval = time.Hour
+	DefaultQueueLifetime         = 5 * 24 * time.Hour
+	DefaultQueueDelayWarning     = 4 * time.Hour
 )
 
 type SendQueue struct {
 	inbound  chan sqInboundMailData
 	outbound chan sqOutboundMailData
 	store    *mailstore.MailStore
+	limiter  *deliveryLimiter
+	conns    *connCache
+
+	// Cancelled when the queue is shutting down
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	Hostname string
+	Resolver dns.Resolver
+	Timeouts smtp.ClientTimeouts
+
+	// Delivery limits (0 means unlimited connections)
+	Workers              int
+	MaxConnections       int
+	MaxDomainConnections int
+
+	// How long to keep idle connections open for reuse (0 disables reuse)
+	IdleTimeout time.Duration
+
+	// Retry schedule for temporary failures: the interval doubles after every
+	// attempt up to MaxRetryInterval, and mail still undelivered after
+	// Lifetime is bounced. Senders are warned once after DelayWarning (0 never).
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	Lifetime         time.Duration
+	DelayWarning     time.Duration
+
+	// STARTTLS policy, the domain policies override the default one
+	TLSPolicy         TLSPolicy
+	DomainTLSPolicies map[string]TLSPolicy
+
+	// MTA-STS policy fetcher (nil disables MTA-STS)
+	MTASTS *mtasts.Fetcher
+
+	// Authenticate servers with DNSSEC-validated TLSA records when available
+	DANE bool
+
+	// Smarthosts to send mail through instead of delivering it directly,
+	// the domain relays override the default one (nil means direct delivery)
+	Relay        *Relay
+	DomainRelays map[string]*Relay
+
+	// DKIM signers for local domains
+	DKIMSigners map[string]*dkim.Signer
+
+	// DMARC results to send aggregate reports for (nil disables reports)
+	DMARCReports *dmarc.Reporter
 }
 
 type sqInboundMailData struct {
 	Sender    string
 	Recipient string
+	Folder    string
 	Data      *string
 }
 
+// sqOutboundMailData is a single SMTP transaction to a remote domain, all
+// recipients share the same mail servers
 type sqOutboundMailData struct {
-	Sender       string
-	Recipient    string
-	RemoteDomain string
-	Data         *string
+	Sender      string
+	Recipients  []string
+	Domain      string
+	RemoteHosts []string
+	Data        *string
+
+	// Whether the MX records were DNSSEC authenticated
+	MXAuthenticated bool
+
+	// When the mail was queued and how many times delivery failed since
+	Queued   time.Time
+	Attempts int
+
+	// Whether the sender was told that delivery is delayed
+	DelayNotified bool
 }
 
 func NewSendQueue(hostname string, store *mailstore.MailStore) *SendQueue {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &SendQueue{
 		inbound:  make(chan sqInboundMailData),
 		outbound: make(chan sqOutboundMailData),
 		store:    store,
+		ctx:      ctx,
+		cancel:   cancel,
 
 		Hostname: hostname,
+		Resolver: dns.NewSystemResolver(),
+		Timeouts: smtp.DefaultClientTimeouts,
+
+		Workers:              DefaultQueueWorkers,
+		MaxConnections:       DefaultQueueMaxConnections,
+		MaxDomainConnections: DefaultQueueMaxDomainConnections,
+		IdleTimeout:          DefaultQueueIdleTimeout,
+
+		RetryInterval:    DefaultQueueRetryInterval,
+		MaxRetryInterval: DefaultQueueMaxRetryInterval,
+		Lifetime:         DefaultQueueLifetime,
+		DelayWarning:     DefaultQueueDelayWarning,
+
+		TLSPolicy:         TLSOpportunistic,
+		DomainTLSPolicies: make(map[string]TLSPolicy),
+		DANE:              true,
+
+		DomainRelays: make(map[string]*Relay),
+		DKIMSigners:  make(map[string]*dkim.Signer),
 	}
 }
 
 func (s *SendQueue) QueueMail(envelope smtp.ServerEnvelope) {
+	folder := ""
+	if envelope.Quarantine {
+		folder = mailstore.JunkFolder
+	}
+	s.queueEnvelope(envelope.Sender, envelope.Recipients, &envelope.Data, folder)
+}
+
+// queueEnvelope queues a message for delivery, local recipients get it in
+// the given folder (empty for their inbox)
+func (s *SendQueue) queueEnvelope(sender string, recipients []string, data *string, folder string) {
 	var toSend []interface{}
 
-	for _, recipient := range envelope.Recipients {
-		if envelope.Client.IsAddressInternal(recipient) {
+	// Group remote recipients by domain (keeping the order they came in)
+	var domains []string
+	remote := make(map[string][]string)
+
+	for _, recipient := range recipients {
+		_, host := email.SplitAddress(recipient)
+		if s.store.IsLocalDomain(host) {
 			toSend = append(toSend, sqInboundMailData{
-				Sender:    envelope.Sender,
+				Sender:    sender,
 				Recipient: recipient,
-				Data:      &envelope.Data,
+				Folder:    folder,
+				Data:      data,
 			})
 		} else {
-			_, host := email.SplitAddress(recipient)
-			remoteServer, err := getRemoteServerAddr(host)
-			if err != nil {
-				s.HandleDeliveryError(envelope.Sender, err)
+			host = strings.ToLower(host)
+			if _, ok := remote[host]; !ok {
+				domains = append(domains, host)
 			}
-			toSend = append(toSend, sqOutboundMailData{
-				Sender:       envelope.Sender,
-				Recipient:    recipient,
-				RemoteDomain: remoteServer,
-				Data:         &envelope.Data,
-			})
+			remote[host] = append(remote[host], recipient)
+		}
+	}
+
+	// Sign mail leaving the server, now that all our headers are in place
+	if len(domains) > 0 {
+		data = s.signOutbound(sender, data)
+	}
+
+	now := time.Now()
+	for _, domain := range domains {
+		mail := sqOutboundMailData{
+			Sender:     sender,
+			Recipients: remote[domain],
+			Domain:     domain,
+			Data:       data,
+			Queued:     now,
+		}
+		if err := s.resolveOutbound(&mail); err != nil {
+			log.Printf("Error while resolving mail server for %s:\n\t%s\n", domain, err.Error())
+			s.deliveryFailed(mail, err)
+			continue
 		}
+		toSend = append(toSend, mail)
 	}
 
 	go func() {
 		for _, mail := range toSend {
 			switch m := mail.(type) {
 			case sqInboundMailData:
-				s.inbound <- m
+				select {
+				case s.inbound <- m:
+				case <-s.ctx.Done():
+					return
+				}
 			case sqOutboundMailData:
-				s.outbound <- m
+				select {
+				case s.outbound <- m:
+				case <-s.ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -92,73 +239,383 @@ func (s *SendQueue) SaveIntenalMail(data sqInboundMailData) error {
 	DeliveredTo := fmt.Sprintf("Delivered-To: %s\n", data.Recipient)
 	msgdata := DeliveredTo + *data.Data
 
-	return s.store.Save(mailstore.InboundMailData{
+	err := s.store.Save(mailstore.InboundMailData{
 		Recipient:  data.Recipient,
 		RealSender: data.Sender,
+		Folder:     data.Folder,
 		MailData:   msgdata,
 	})
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
 func (s *SendQueue) SendExternalMail(data sqOutboundMailData) error {
-	client, err := smtp.NewClient(data.RemoteDomain)
-	if err != nil {
-		return errors.NewError(ErrSQCannotConnectToRemote).WithError(err)
+	if relay := s.relayFor(data.Domain); relay != nil {
+		return s.sendThroughRelay(data, relay)
 	}
-	if err = client.Greet(s.Hostname); err != nil {
-		return errors.NewError(ErrSQCommunicationErrorRemote).WithError(err)
+
+	var lastErr error
+
+	// Apply the MTA-STS policy of the domain, if it has one
+	hosts, policy, stsResult := s.applySTSPolicy(data.Domain, data.RemoteHosts, s.tlsPolicyFor(data.Domain))
+	if stsResult != "" {
+		log.Printf("[meirud] Delivering to %s (%s)\n", data.Domain, stsResult)
+	}
+	if len(hosts) < 1 {
+		return withPolicyInfo(errors.NewError(ErrSQNoValidMX).WithInfo("Domain: %s", data.Domain), stsResult)
 	}
-	if err = client.SetSender(data.Sender); err != nil {
-		return errors.NewError(ErrSQCommunicationErrorRemote).WithError(err)
+
+	// Try each mail server in order of preference until one accepts the mail
+	for _, host := range hosts {
+		// Look for TLSA records if the MX records can be trusted
+		var tlsa []dns.TLSA
+		if data.MXAuthenticated {
+			var err error
+			tlsa, err = s.lookupDANE(host)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+		}
+
+		// Reuse an open connection to the same server if we have one,
+		// connections are only shared between deliveries with the same TLS policy
+		cacheKey := host + "/" + policy.String()
+		if tlsa != nil {
+			cacheKey = host + "/dane"
+		}
+		client := s.conns.get(s.ctx, cacheKey)
+		if client == nil {
+			var err error
+			client, err = s.connect(host, policy, tlsa)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+		}
+
+		// Permanent rejections are final, anything else (4xx replies like
+		// greylisting, dropped connections) might go better on the next server
+		rejected, err := s.sendEnvelope(client, data)
+		if err != nil {
+			client.Close(s.ctx)
+			if anyPermanent(rejected) {
+				s.handleRejected(data, rejected, "Remote host: "+host, stsResult)
+				return nil
+			}
+			senderr := errors.NewError(ErrSQCommunicationErrorRemote).WithError(err).WithInfo("Remote host: %s", host)
+			if smtp.IsPermanentError(err) || s.ctx.Err() != nil {
+				return withPolicyInfo(senderr, stsResult)
+			}
+			lastErr = senderr
+			continue
+		}
+		s.conns.put(cacheKey, client)
+
+		// Handle recipients that were refused by the server one by one
+		s.handleRejected(data, rejected, "Remote host: "+host, stsResult)
+		return nil
 	}
-	if err = client.AddRecipient(data.Recipient); err != nil {
-		return errors.NewError(ErrSQCommunicationErrorRemote).WithError(err)
+
+	return withPolicyInfo(lastErr, stsResult)
+}
+
+func (s *SendQueue) sendThroughRelay(data sqOutboundMailData, relay *Relay) error {
+	cacheKey := "relay/" + relay.Address
+	client := s.conns.get(s.ctx, cacheKey)
+	if client == nil {
+		var err error
+		client, err = s.connectRelay(relay)
+		if err != nil {
+			return err
+		}
 	}
-	if err = client.SendData(*data.Data); err != nil {
-		return errors.NewError(ErrSQCommunicationErrorRemote).WithError(err)
+
+	rejected, err := s.sendEnvelope(client, data)
+	if err != nil {
+		client.Close(s.ctx)
+		if anyPermanent(rejected) {
+			s.handleRejected(data, rejected, "Relay: "+relay.Address, "")
+			return nil
+		}
+		return errors.NewError(ErrSQCommunicationErrorRemote).WithError(err).WithInfo("Relay: %s", relay.Address)
 	}
+	s.conns.put(cacheKey, client)
 
-	client.Close()
+	s.handleRejected(data, rejected, "Relay: "+relay.Address, "")
 	return nil
 }
 
-func (s *SendQueue) HandleDeliveryError(sender string, err error) error {
-	//TODO
-	return nil
+// connect opens a greeted connection to a remote mail server, upgrading it
+// to TLS according to the policy. If the server has TLSA records, TLS is
+// mandatory and the server is authenticated with DANE.
+func (s *SendQueue) connect(host string, policy TLSPolicy, tlsa []dns.TLSA) (*smtp.Client, error) {
+	client, err := smtp.NewClientWithTimeouts(s.ctx, host, s.Timeouts)
+	if err != nil {
+		return nil, errors.NewError(ErrSQCannotConnectToRemote).WithError(err).WithInfo("Remote host: %s", host)
+	}
+	if err = client.Greet(s.ctx, s.Hostname); err != nil {
+		client.Close(s.ctx)
+		return nil, errors.NewError(ErrSQCommunicationErrorRemote).WithError(err).WithInfo("Remote host: %s", host)
+	}
+
+	if tlsa != nil {
+		policy = TLSRequired
+	}
+	if policy == TLSNone {
+		return client, nil
+	}
+
+	if !client.HasExtension("STARTTLS") {
+		if policy == TLSRequired {
+			client.Close(s.ctx)
+			return nil, errors.NewError(ErrSQTLSRequired).WithInfo("Remote host: %s", host).WithInfo("Server does not advertise STARTTLS")
+		}
+		return client, nil
+	}
+
+	// Opportunistic TLS doesn't authenticate the server (RFC 7435), anything
+	// is better than plaintext
+	config := &tls.Config{
+		ServerName:         client.ServerName,
+		InsecureSkipVerify: policy != TLSRequired,
+	}
+	if tlsa != nil {
+		config = smtp.DANEConfig(client.ServerName, tlsa)
+	}
+	if err = client.StartTLS(s.ctx, config); err != nil {
+		client.Close(s.ctx)
+		if policy == TLSRequired {
+			return nil, errors.NewError(ErrSQTLSRequired).WithError(err).WithInfo("Remote host: %s", host)
+		}
+
+		// The connection is unusable after a failed handshake, start over in plaintext
+		log.Printf("[meirud] STARTTLS with %s failed, falling back to plaintext:\n\t%s\n", host, err.Error())
+		return s.connect(host, TLSNone, nil)
+	}
+
+	// Greet again, the server forgot about us after STARTTLS
+	if err = client.Greet(s.ctx, s.Hostname); err != nil {
+		client.Close(s.ctx)
+		return nil, errors.NewError(ErrSQCommunicationErrorRemote).WithError(err).WithInfo("Remote host: %s", host)
+	}
+
+	return client, nil
+}
+
+// sendEnvelope runs a mail transaction for all the recipients of the envelope,
+// recipients refused by the server are returned with the reason they were refused
+// (even if the transaction failed because they were all refused)
+func (s *SendQueue) sendEnvelope(client *smtp.Client, data sqOutboundMailData) (map[string]error, error) {
+	rejected, err := client.Send(s.ctx, data.Sender, data.Recipients, strings.NewReader(*data.Data), uint64(len(*data.Data)))
+	if e, ok := err.(*errors.Error); ok && e.Type == smtp.ClientErrNoValidRecipients {
+		return rejected, errors.NewError(ErrSQAllRecipientsRejected).WithError(e.SubError)
+	}
+	return rejected, err
+}
+
+// HandleDeliveryError notifies the sender that a message could not be
+// delivered to some of its recipients and won't be retried
+func (s *SendQueue) HandleDeliveryError(sender string, recipients []string, data *string, err error) {
+	// Never bounce bounces (null sender)
+	if sender == "" {
+		return
+	}
+
+	// Deliveries aborted because we are shutting down are not the sender's fault
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	bounce := makeBounce(s.Hostname, sender, recipients, data, err)
+	s.queueEnvelope("", []string{sender}, &bounce, "")
+}
+
+// Serve starts the delivery workers and blocks until one of them fails or
+// the queue is closed
+func (s *SendQueue) Serve() error {
+	errch := make(chan error)
+	s.limiter = newDeliveryLimiter(s.MaxConnections, s.MaxDomainConnections)
+	s.conns = newConnCache(s.IdleTimeout)
+	go s.conns.expireLoop(s.ctx)
+	if s.DMARCReports != nil {
+		go s.reportLoop(s.ctx)
+	}
+
+	// Local delivery has its own worker so it's never stuck behind remote servers
+	runWorker(errch, s.serveInbound)
+
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		runWorker(errch, s.serveOutbound)
+	}
+
+	select {
+	case err := <-errch:
+		return err
+	case <-s.ctx.Done():
+		s.conns.closeAll(context.Background())
+		return nil
+	}
+}
+
+// Close aborts all deliveries in progress and stops the queue
+func (s *SendQueue) Close() {
+	s.cancel()
 }
 
-func (s *SendQueue) Serve() (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err, _ = r.(error)
+func (s *SendQueue) serveInbound() {
+	for {
+		var inboundMail sqInboundMailData
+		select {
+		case inboundMail = <-s.inbound:
+		case <-s.ctx.Done():
+			return
 		}
-	}()
 
+		err := s.SaveIntenalMail(inboundMail)
+		if err != nil {
+			log.Printf("Error while saving mail for %s:\n\t%s\n", inboundMail.Recipient, err.Error())
+			s.HandleDeliveryError(inboundMail.Sender, []string{inboundMail.Recipient}, inboundMail.Data, err)
+		}
+	}
+}
+
+func (s *SendQueue) serveOutbound() {
 	for {
+		var outboundMail sqOutboundMailData
 		select {
-		case inboundMail := <-s.inbound:
-			err := s.SaveIntenalMail(inboundMail)
-			if err != nil {
-				log.Printf("Error while saving mail for %s:\n\t%s\n", inboundMail.Recipient, err.Error())
-				s.HandleDeliveryError(inboundMail.Sender, err)
-			}
-		case outboundMail := <-s.outbound:
+		case outboundMail = <-s.outbound:
+		case <-s.ctx.Done():
+			return
+		}
+
+		// Wait for a free connection slot, if the domain has none left the
+		// mail is parked and will be picked up by whoever frees one
+		if !s.limiter.acquire(outboundMail) {
+			continue
+		}
+
+		for {
 			err := s.SendExternalMail(outboundMail)
 			if err != nil {
-				log.Printf("Error while delivering mail to %s:\n\t%s\n", outboundMail.Recipient, err.Error())
-				s.HandleDeliveryError(outboundMail.Sender, err)
+				log.Printf("Error while delivering mail to %s:\n\t%s\n", strings.Join(outboundMail.Recipients, ", "), err.Error())
+				s.deliveryFailed(outboundMail, err)
 			}
+
+			// Keep the slot if there is more mail waiting for the same domain
+			next, ok := s.limiter.release(outboundMail.Domain)
+			if !ok {
+				break
+			}
+			outboundMail = next
 		}
 	}
 }
 
-func getRemoteServerAddr(host string) (string, error) {
-	mx, err := net.LookupMX(host)
+func runWorker(errch chan<- error, fn func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err, ok := r.(error)
+				if !ok {
+					err = fmt.Errorf("%v", r)
+				}
+				errch <- err
+			}
+		}()
+		fn()
+	}()
+}
+
+// resolveOutbound looks up the mail servers for an envelope, unless it's
+// going through a relay which doesn't need to know about MX records
+func (s *SendQueue) resolveOutbound(data *sqOutboundMailData) error {
+	if s.relayFor(data.Domain) != nil {
+		return nil
+	}
+	hosts, authenticated, err := s.getRemoteServerAddrs(data.Domain)
 	if err != nil {
-		return "", err
+		return err
+	}
+	data.RemoteHosts = hosts
+	data.MXAuthenticated = authenticated
+	return nil
+}
+
+// getRemoteServerAddrs returns the mail servers for a domain ordered by MX
+// preference, servers with the same preference are shuffled (RFC 5321 section 5.1).
+// When DANE is enabled it also returns whether the records were DNSSEC authenticated.
+func (s *SendQueue) getRemoteServerAddrs(host string) ([]string, bool, error) {
+	var mx []*net.MX
+	var authenticated bool
+	var err error
+	if s.DANE {
+		mx, authenticated, err = s.Resolver.LookupMXAuthenticated(s.ctx, host)
+		// Don't let DANE get in the way of delivery, retry without it
+		if err != nil && !dns.IsNotFound(err) {
+			log.Printf("[meirud] DNSSEC lookup of MX records for %s failed, falling back to regular lookup:\n\t%s\n", host, err.Error())
+			mx, err = s.Resolver.LookupMX(s.ctx, host)
+			authenticated = false
+		}
+	} else {
+		mx, err = s.Resolver.LookupMX(s.ctx, host)
+	}
+	if err != nil {
+		// No MX records, use the domain itself as implicit MX
+		if dns.IsNotFound(err) {
+			hosts, err := s.getImplicitMX(host)
+			return hosts, false, err
+		}
+		return nil, false, errors.NewError(ErrSQCannotResolveDomain).WithError(err).WithInfo("Domain: %s", host)
 	}
-	//TODO Return array and order by preference
 	if len(mx) < 1 {
-		return "", errors.NewError(ErrSQCannotResolveDomain)
+		hosts, err := s.getImplicitMX(host)
+		return hosts, false, err
 	}
-	return mx[0].Host, nil
+
+	// A single "." MX means the domain does not accept mail (RFC 7505)
+	if len(mx) == 1 && isNullMX(mx[0].Host) {
+		return nil, false, errors.NewError(ErrSQNullMX).WithInfo("Domain: %s", host)
+	}
+
+	// Shuffle first so that the stable sort randomizes equal preferences
+	for i := range mx {
+		j := rand.Intn(i + 1)
+		mx[i], mx[j] = mx[j], mx[i]
+	}
+	sort.SliceStable(mx, func(i, j int) bool {
+		return mx[i].Pref < mx[j].Pref
+	})
+
+	hosts := make([]string, 0, len(mx))
+	for _, record := range mx {
+		if isNullMX(record.Host) {
+			continue
+		}
+		hosts = append(hosts, strings.TrimSuffix(record.Host, "."))
+	}
+	return hosts, authenticated, nil
+}
+
+// getImplicitMX checks that a domain without MX records has an address record
+// so it can be treated as its own mail server
+func (s *SendQueue) getImplicitMX(host string) ([]string, error) {
+	addrs, err := s.Resolver.LookupIP(s.ctx, host)
+	if err != nil {
+		return nil, errors.NewError(ErrSQCannotResolveDomain).WithError(err).WithInfo("Domain: %s", host)
+	}
+	if len(addrs) < 1 {
+		return nil, errors.NewError(ErrSQCannotResolveDomain).WithInfo("Domain: %s", host)
+	}
+	return []string{host}, nil
+}
+
+func isNullMX(host string) bool {
+	return host == "." || host == ""
 }
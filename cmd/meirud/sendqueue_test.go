@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/errors"
+	"github.com/hamcha/meiru/lib/mailstore"
+)
+
+// failingResolver answers MX lookups with a temporary failure (SERVFAIL)
+type failingResolver struct {
+	*dns.FakeResolver
+}
+
+func (f failingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+}
+
+func (f failingResolver) LookupMXAuthenticated(ctx context.Context, name string) ([]*net.MX, bool, error) {
+	mx, err := f.LookupMX(ctx, name)
+	return mx, false, err
+}
+
+func TestGetRemoteServerAddrs(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+	resolver.MX["ordered.test"] = []*net.MX{
+		{Host: "mx3.ordered.test.", Pref: 30},
+		{Host: "mx1.ordered.test.", Pref: 10},
+		{Host: "mx2.ordered.test.", Pref: 20},
+	}
+	resolver.MX["equal.test"] = []*net.MX{
+		{Host: "backup.equal.test.", Pref: 20},
+		{Host: "a.equal.test.", Pref: 10},
+		{Host: "b.equal.test.", Pref: 10},
+		{Host: "c.equal.test.", Pref: 10},
+	}
+	resolver.MX["null.test"] = []*net.MX{{Host: ".", Pref: 0}}
+	resolver.MX["empty.test"] = []*net.MX{}
+	resolver.IP["empty.test"] = []net.IP{net.ParseIP("192.0.2.1")}
+	resolver.IP["implicit.test"] = []net.IP{net.ParseIP("192.0.2.2")}
+	resolver.IP["implicit6.test"] = []net.IP{net.ParseIP("2001:db8::1")}
+
+	tests := []struct {
+		name string
+		host string
+		// Hosts grouped by preference, hosts with the same preference can
+		// come in any order
+		want    [][]string
+		wantErr *errors.ErrorType
+	}{
+		{"preference ordering", "ordered.test", [][]string{{"mx1.ordered.test"}, {"mx2.ordered.test"}, {"mx3.ordered.test"}}, nil},
+		{"equal preferences", "equal.test", [][]string{{"a.equal.test", "b.equal.test", "c.equal.test"}, {"backup.equal.test"}}, nil},
+		{"null MX", "null.test", nil, ErrSQNullMX},
+		{"implicit MX from A record", "implicit.test", [][]string{{"implicit.test"}}, nil},
+		{"implicit MX from AAAA record", "implicit6.test", [][]string{{"implicit6.test"}}, nil},
+		{"implicit MX from empty MX answer", "empty.test", [][]string{{"empty.test"}}, nil},
+		{"no MX and no address", "nxdomain.test", nil, ErrSQCannotResolveDomain},
+	}
+
+	s := NewSendQueue("mx.test", mailstore.NewStore())
+	s.Resolver = resolver
+	for _, test := range tests {
+		// Run a few times since equal preferences are shuffled
+		for i := 0; i < 10; i++ {
+			hosts, _, err := s.getRemoteServerAddrs(test.host)
+			if test.wantErr != nil {
+				if err == nil {
+					t.Errorf("%s: expected error, got %q", test.name, hosts)
+				} else if err.(*errors.Error).Type != test.wantErr {
+					t.Errorf("%s: got error %q, want %q", test.name, err.Error(), test.wantErr.Message)
+				}
+				break
+			}
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+				break
+			}
+			if got := groupLike(hosts, test.want); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: got %q, want %q", test.name, hosts, test.want)
+				break
+			}
+		}
+	}
+}
+
+// groupLike splits hosts into groups of the same sizes as want, sorting each
+// group so that shuffled hosts of equal preference compare equal
+func groupLike(hosts []string, want [][]string) [][]string {
+	var groups [][]string
+	for _, group := range want {
+		if len(hosts) < len(group) {
+			return append(groups, hosts)
+		}
+		sorted := append([]string(nil), hosts[:len(group)]...)
+		sort.Strings(sorted)
+		groups = append(groups, sorted)
+		hosts = hosts[len(group):]
+	}
+	if len(hosts) > 0 {
+		groups = append(groups, hosts)
+	}
+	return groups
+}
+
+func TestGetRemoteServerAddrsFailures(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+	resolver.MX["null.test"] = []*net.MX{{Host: ".", Pref: 0}}
+
+	tests := []struct {
+		name      string
+		resolver  dns.Resolver
+		host      string
+		permanent bool
+	}{
+		{"null MX is permanent", resolver, "null.test", true},
+		{"missing domain is permanent", resolver, "nxdomain.test", true},
+		{"server failure is temporary", failingResolver{resolver}, "servfail.test", false},
+	}
+
+	s := NewSendQueue("mx.test", mailstore.NewStore())
+	for _, test := range tests {
+		s.Resolver = test.resolver
+		_, _, err := s.getRemoteServerAddrs(test.host)
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		if got := isPermanentFailure(err); got != test.permanent {
+			t.Errorf("%s: permanent = %v, want %v (%s)", test.name, got, test.permanent, err.Error())
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"strconv"
+	"strings"
+)
+
+// SHA-512-crypt as used by glibc and Dovecot ("$6$"), as specified in
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	sha512CryptPrefix        = "$6$"
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSalt       = 16
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Order in which the digest bytes are encoded, three at a time
+var sha512CryptOrder = [...][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// checkSHA512Crypt checks a password against a "$6$[rounds=N$]salt$hash" string
+func checkSHA512Crypt(hashed, password string) bool {
+	if !strings.HasPrefix(hashed, sha512CryptPrefix) {
+		return false
+	}
+	settings := hashed[:strings.LastIndexByte(hashed, '$')]
+	computed, ok := sha512Crypt(password, settings)
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+}
+
+// sha512Crypt hashes a password with the salt and rounds in settings
+// ("$6$[rounds=N$]salt"), returning the full crypt string
+func sha512Crypt(password, settings string) (string, bool) {
+	if !strings.HasPrefix(settings, sha512CryptPrefix) {
+		return "", false
+	}
+	rest := settings[len(sha512CryptPrefix):]
+
+	rounds := sha512CryptDefaultRounds
+	customRounds := false
+	if strings.HasPrefix(rest, "rounds=") {
+		end := strings.IndexByte(rest, '$')
+		if end < 0 {
+			return "", false
+		}
+		n, err := strconv.Atoi(rest[len("rounds="):end])
+		if err != nil {
+			return "", false
+		}
+		rounds = n
+		if rounds < sha512CryptMinRounds {
+			rounds = sha512CryptMinRounds
+		}
+		if rounds > sha512CryptMaxRounds {
+			rounds = sha512CryptMaxRounds
+		}
+		customRounds = true
+		rest = rest[end+1:]
+	}
+
+	salt := rest
+	if end := strings.IndexByte(salt, '$'); end >= 0 {
+		salt = salt[:end]
+	}
+	if len(salt) > sha512CryptMaxSalt {
+		salt = salt[:sha512CryptMaxSalt]
+	}
+
+	pw := []byte(password)
+	sb := []byte(salt)
+
+	// Alternate sum
+	alt := sha512.New()
+	alt.Write(pw)
+	alt.Write(sb)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pw)
+	a.Write(sb)
+	for n := len(pw); n > 0; n -= 64 {
+		if n > 64 {
+			a.Write(altSum)
+		} else {
+			a.Write(altSum[:n])
+		}
+	}
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(pw)
+		}
+	}
+	sum := a.Sum(nil)
+
+	// Byte sequences P and S
+	dp := sha512.New()
+	for i := 0; i < len(pw); i++ {
+		dp.Write(pw)
+	}
+	p := repeatTo(dp.Sum(nil), len(pw))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(sb)
+	}
+	s := repeatTo(ds.Sum(nil), len(sb))
+
+	for r := 0; r < rounds; r++ {
+		c := sha512.New()
+		if r&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if r%3 != 0 {
+			c.Write(s)
+		}
+		if r%7 != 0 {
+			c.Write(p)
+		}
+		if r&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512CryptPrefix)
+	if customRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for _, group := range sha512CryptOrder {
+		encodeCrypt64(&out, uint(sum[group[0]])<<16|uint(sum[group[1]])<<8|uint(sum[group[2]]), 4)
+	}
+	encodeCrypt64(&out, uint(sum[63]), 2)
+
+	return out.String(), true
+}
+
+func repeatTo(block []byte, length int) []byte {
+	out := make([]byte, 0, length)
+	for len(out) < length {
+		n := length - len(out)
+		if n > len(block) {
+			n = len(block)
+		}
+		out = append(out, block[:n]...)
+	}
+	return out
+}
+
+func encodeCrypt64(out *strings.Builder, value uint, chars int) {
+	for i := 0; i < chars; i++ {
+		out.WriteByte(cryptAlphabet[value&0x3f])
+		value >>= 6
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+// TLSPolicy is how hard we try to encrypt connections to a remote mail server
+type TLSPolicy int
+
+const (
+	// TLSNone never uses STARTTLS
+	TLSNone TLSPolicy = iota
+	// TLSOpportunistic uses STARTTLS when available, without verifying certificates
+	TLSOpportunistic
+	// TLSRequired refuses to deliver without STARTTLS and a valid certificate
+	TLSRequired
+)
+
+var (
+	ErrSQTLSRequired      = errors.NewType(ErrSrcSendqueue, "TLS is required but could not be established")
+	ErrSQInvalidTLSPolicy = errors.NewType(ErrSrcSendqueue, "invalid TLS policy")
+)
+
+var tlsPolicyNames = map[string]TLSPolicy{
+	"none":          TLSNone,
+	"opportunistic": TLSOpportunistic,
+	"required":      TLSRequired,
+}
+
+// ParseTLSPolicy converts a policy name from the configuration file
+func ParseTLSPolicy(name string) (TLSPolicy, bool) {
+	policy, ok := tlsPolicyNames[strings.ToLower(name)]
+	return policy, ok
+}
+
+// UnmarshalText allows policies to be decoded straight from the configuration
+func (p *TLSPolicy) UnmarshalText(text []byte) error {
+	policy, ok := ParseTLSPolicy(string(text))
+	if !ok {
+		return errors.NewError(ErrSQInvalidTLSPolicy).WithInfo("'%s' is not one of none, opportunistic, required", text)
+	}
+	*p = policy
+	return nil
+}
+
+func (p TLSPolicy) String() string {
+	for name, policy := range tlsPolicyNames {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// tlsPolicyFor returns the TLS policy to use when delivering mail to a domain
+func (s *SendQueue) tlsPolicyFor(domain string) TLSPolicy {
+	if policy, ok := s.DomainTLSPolicies[strings.ToLower(domain)]; ok {
+		return policy
+	}
+	return s.TLSPolicy
+}
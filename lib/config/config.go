@@ -1,6 +1,9 @@
 package config
 
-import "io/ioutil"
+import (
+	"fmt"
+	"io/ioutil"
+)
 
 /*
 
@@ -8,11 +11,17 @@ An attempt to make a relodable and flexible yet dead simple configuration file f
 
 Example config:
 
+@define MAILDIR /mail
+@env MODE development
+
 bind localhost local.domain 127.0.0.1
 
 default:
-	box /mail/:name
-	limit 100M
+	box ${MAILDIR}/:name
+	@if ${MODE} = production:
+		limit 1G
+	@else:
+		limit 100M
 
 user admin:
 	limit none
@@ -20,7 +29,13 @@ user admin:
 user ext:
 	@include users/ext.conf
 
-@include rest.conf
+@include rest.conf users/*.conf
+
+Lines starting with @ are preprocessor directives, they work at any level:
+	@define NAME value   sets ${NAME}, unknown ${...} are left as they are
+	@env NAME [default]  sets ${NAME} from the environment
+	@if / @else          keep one of two blocks, see pCondition
+	@include path...     merges other files, glob patterns are accepted
 
 */
 
@@ -34,6 +49,16 @@ type Property struct {
 	Key    string
 	Values []string
 	Block  Block
+
+	// Where the property was defined (line and column start from 1)
+	File   string
+	Line   int
+	Column int
+}
+
+// Position returns where the property was defined as "file:line:column"
+func (p Property) Position() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
 }
 
 func LoadConfig(path string) (Config, error) {
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"encoding"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Decode fills a struct with the contents of the block found at path.
+// Fields are matched to properties using their "config" tag:
+//
+//	type Options struct {
+//		Workers  int            `config:"workers"`
+//		MaxSize  uint64         `config:"max_size,bytes"`
+//		Bind     string         `config:"bind,addr"`
+//		Timeouts TimeoutOptions `config:"timeouts"`
+//	}
+//
+// Supported field types are strings, integers, booleans (on/off),
+// durations, []string (all values of the property), map[string]string
+// (one "key value" pair per property), nested structs (sub blocks) and
+// anything implementing encoding.TextUnmarshaler.
+// Fields without a matching property, or whose value fails to parse, are left
+// untouched, so defaults can be set before decoding.
+func (cfg Config) Decode(path string, out interface{}) *errors.Error {
+	return cfg.DecodeSub(path, cfg.Data, out)
+}
+
+// DecodeSub is Decode with a path relative to a block
+func (cfg Config) DecodeSub(path string, start Block, out interface{}) *errors.Error {
+	target := reflect.ValueOf(out)
+	if target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Struct {
+		return errors.NewError(QueryErrInvalidTarget).WithInfo("Type: %T", out)
+	}
+
+	results, err := cfg.QuerySub(path, start)
+	if err != nil {
+		return err
+	}
+	if len(results) < 1 {
+		return errors.NewError(QueryErrSingleTooFewResults).WithInfo("Path: %s", path)
+	}
+
+	return decodeBlock(results[0].Block, target.Elem())
+}
+
+func decodeBlock(block Block, target reflect.Value) *errors.Error {
+	targetType := target.Type()
+	for i := 0; i < targetType.NumField(); i++ {
+		field := targetType.Field(i)
+		tag := field.Tag.Get("config")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name, option := tag, ""
+		if comma := strings.IndexByte(tag, ','); comma >= 0 {
+			name, option = tag[:comma], tag[comma+1:]
+		}
+
+		var properties []Property
+		for _, property := range block {
+			if strings.EqualFold(property.Key, name) {
+				properties = append(properties, property)
+			}
+		}
+		if len(properties) < 1 {
+			continue
+		}
+
+		if err := decodeField(properties, target.Field(i), option); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeField(properties []Property, field reflect.Value, option string) *errors.Error {
+	property := properties[0]
+
+	// Types that know how to parse themselves come first, since they can
+	// be of any kind
+	if field.Addr().Type().Implements(textUnmarshalerType) {
+		if len(property.Values) < 1 {
+			return missingValue(property)
+		}
+		return decodeValue(property, property.Values[0], field, option)
+	}
+
+	switch field.Kind() {
+	case reflect.Struct:
+		if field.Type() == durationType {
+			break
+		}
+		return decodeBlock(property.Block, field)
+
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return unsupportedField(property, field)
+		}
+		field.Set(reflect.ValueOf(append([]string(nil), property.Values...)).Convert(field.Type()))
+		return nil
+
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String {
+			return unsupportedField(property, field)
+		}
+		if field.IsNil() {
+			field.Set(reflect.MakeMap(field.Type()))
+		}
+		for _, property := range properties {
+			if len(property.Values) < 2 {
+				return errors.NewError(QueryErrSingleTooFewValues).WithInfo("%s: '%s' needs a key and a value", property.Position(), property.Key)
+			}
+			value := reflect.New(field.Type().Elem()).Elem()
+			if err := decodeValue(property, property.Values[1], value, option); err != nil {
+				return err
+			}
+			field.SetMapIndex(reflect.ValueOf(property.Values[0]).Convert(field.Type().Key()), value)
+		}
+		return nil
+	}
+
+	if len(property.Values) < 1 {
+		return missingValue(property)
+	}
+	return decodeValue(property, property.Values[0], field, option)
+}
+
+// decodeValue parses a value into a field, which is only changed if the value
+// is valid so that defaults survive errors
+func decodeValue(property Property, value string, field reflect.Value, option string) *errors.Error {
+	if _, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		// Unmarshal into a copy, a failed call could leave the field half-set
+		decoded := reflect.New(field.Type())
+		if err := decoded.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value)); err != nil {
+			return invalidValue(property, value, err)
+		}
+		field.Set(decoded.Elem())
+		return nil
+	}
+
+	switch {
+	case field.Type() == durationType:
+		duration, err := ParseDuration(value)
+		if err != nil {
+			return invalidValue(property, value, err)
+		}
+		field.SetInt(int64(duration))
+
+	case field.Kind() == reflect.String:
+		str := value
+		if option == "addr" {
+			var err error
+			str, err = ParseAddr(value)
+			if err != nil {
+				return invalidValue(property, value, err)
+			}
+		}
+		field.SetString(str)
+
+	case field.Kind() == reflect.Bool:
+		flag, err := ParseBool(value)
+		if err != nil {
+			return invalidValue(property, value, err)
+		}
+		field.SetBool(flag)
+
+	case field.Kind() >= reflect.Int && field.Kind() <= reflect.Int64:
+		num, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return invalidValue(property, value, err)
+		}
+		field.SetInt(num)
+
+	case field.Kind() >= reflect.Uint && field.Kind() <= reflect.Uint64:
+		var num uint64
+		var err error
+		if option == "bytes" {
+			num, err = ParseByteSize(value)
+			if err == nil && field.OverflowUint(num) {
+				err = errors.NewError(ValueErrInvalid).WithInfo("'%s' is too big", value)
+			}
+		} else {
+			num, err = strconv.ParseUint(value, 10, field.Type().Bits())
+		}
+		if err != nil {
+			return invalidValue(property, value, err)
+		}
+		field.SetUint(num)
+
+	default:
+		return unsupportedField(property, field)
+	}
+
+	return nil
+}
+
+func missingValue(property Property) *errors.Error {
+	return errors.NewError(QueryErrSingleTooFewValues).WithInfo("%s: '%s' needs a value", property.Position(), property.Key)
+}
+
+func unsupportedField(property Property, field reflect.Value) *errors.Error {
+	return errors.NewError(QueryErrUnsupportedField).WithInfo("%s: cannot decode '%s' into %s", property.Position(), property.Key, field.Type())
+}
@@ -0,0 +1,497 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/hamcha/meiru/lib/errors"
+	"github.com/hamcha/meiru/lib/utils"
+)
+
+var (
+	ErrSrcDocument errors.ErrorSource = "cfg document"
+
+	DocErrorIncludeLoop = errors.NewType(ErrSrcDocument, "file includes itself")
+)
+
+// Document is a configuration file kept line by line, so that it can be
+// edited and written back without losing comments or formatting.
+// Included files are loaded as documents of their own.
+type Document struct {
+	Path string
+	Root *Node
+
+	// Content as it was read, to know if the file needs saving
+	original string
+
+	// Whether the last line ends with a newline
+	finalNewline bool
+}
+
+// Node is a line of a configuration document. Lines without a key are
+// blank lines or comments and are kept as they are.
+type Node struct {
+	Key      string
+	Values   []string
+	Children []*Node
+	IsBlock  bool
+
+	// Documents loaded by an @include node, one per file
+	Includes []*Document
+
+	document *Document
+	parent   *Node
+	line     int
+	indent   string
+	comment  string
+	raw      string
+	dirty    bool
+}
+
+// LoadDocument reads a configuration file for editing, including the
+// files it references with @include
+func LoadDocument(path string) (*Document, error) {
+	return loadDocument(path, nil)
+}
+
+func loadDocument(path string, parents []string) (*Document, error) {
+	path = filepath.Clean(path)
+	for _, parent := range parents {
+		if parent == path {
+			return nil, errors.NewError(DocErrorIncludeLoop).WithInfo("File <%s>", path)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &Document{
+		Path:         path,
+		original:     string(data),
+		finalNewline: len(data) < 1 || data[len(data)-1] == '\n',
+	}
+	doc.Root, err = parseDocument(doc, string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// Load included files relative to this one, paths using variables
+	// can't be resolved without running the preprocessor and are skipped
+	includes := doc.Root.FindAll("@include")
+	for _, include := range includes {
+		for _, value := range include.Values {
+			if strings.Contains(value, "${") {
+				continue
+			}
+			files, err := includedFiles(filepath.Dir(path), value)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				included, err := loadDocument(file, append(parents, path))
+				if err != nil {
+					return nil, err
+				}
+				include.Includes = append(include.Includes, included)
+			}
+		}
+	}
+
+	return doc, nil
+}
+
+func parseDocument(doc *Document, configfile string) (*Node, error) {
+	root := &Node{IsBlock: true, document: doc}
+	scope := []*Node{root}
+
+	lines := strings.Split(configfile, "\n")
+	// A trailing newline doesn't start another line
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for lineNumber, raw := range lines {
+		content, comment := splitComment(strings.TrimRight(raw, "\r"))
+		content = strings.Replace(content, "\\#", "#", -1)
+		content = strings.TrimRightFunc(content, unicode.IsSpace)
+
+		trimline := strings.TrimSpace(content)
+		if len(trimline) < 1 {
+			// Blank lines and comments stay in the innermost open block
+			current := scope[len(scope)-1]
+			current.appendChild(&Node{raw: raw, comment: comment, line: lineNumber + 1})
+			continue
+		}
+
+		indent := len(content) - len(trimline)
+		isBlock := strings.HasSuffix(trimline, ":")
+		if isBlock {
+			trimline = strings.TrimRight(trimline, ":")
+		}
+
+		if indent >= len(scope) {
+			return nil, errors.NewError(ParseErrorIndentMismatch).WithInfo("File <%s> Line %d", doc.Path, lineNumber+1)
+		}
+		if indent < len(scope)-1 {
+			// Blank lines and comments right before this line belong to
+			// its block, not the one being closed
+			scope[indent].appendChild(scope[len(scope)-1].popTrivia()...)
+			scope = scope[:indent+1]
+		}
+
+		atoms, err := utils.SplitQuotes(trimline)
+		if err != nil {
+			if err == utils.ErrSplitUnmatchedQuote {
+				err = errors.NewError(ParseErrorUnmatchedQuote).WithInfo("File <%s> Line %d", doc.Path, lineNumber+1)
+			}
+			return nil, err
+		}
+
+		node := &Node{
+			Key:     atoms[0],
+			Values:  atoms[1:],
+			IsBlock: isBlock,
+			line:    lineNumber + 1,
+			indent:  content[:indent],
+			comment: comment,
+			raw:     raw,
+		}
+		scope[indent].appendChild(node)
+		if isBlock {
+			scope = append(scope, node)
+		}
+	}
+
+	return root, nil
+}
+
+// splitComment separates a line from its comment (# not preceded by \)
+func splitComment(line string) (string, string) {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] != '\\') {
+			return line[:i], line[i:]
+		}
+	}
+	return line, ""
+}
+
+func (n *Node) appendChild(children ...*Node) {
+	for _, child := range children {
+		child.parent = n
+		child.document = n.document
+		n.Children = append(n.Children, child)
+	}
+}
+
+// popTrivia removes the blank lines and comments at the end of a block
+func (n *Node) popTrivia() []*Node {
+	end := len(n.Children)
+	for end > 0 && n.Children[end-1].Key == "" {
+		end--
+	}
+	trivia := n.Children[end:]
+	n.Children = n.Children[:end]
+	return trivia
+}
+
+// File returns the path of the file the node is in
+func (n *Node) File() string {
+	if n.document == nil {
+		return ""
+	}
+	return n.document.Path
+}
+
+// Line returns the line the node was read from (0 for added nodes)
+func (n *Node) Line() int {
+	return n.line
+}
+
+// Comment returns the comment at the end of the node's line, if any
+func (n *Node) Comment() string {
+	return n.comment
+}
+
+// Parent returns the block containing the node (nil for the root)
+func (n *Node) Parent() *Node {
+	return n.parent
+}
+
+// Properties returns the children that aren't blank lines or comments,
+// with the contents of included files in place of @include lines
+func (n *Node) Properties() []*Node {
+	var out []*Node
+	for _, child := range n.Children {
+		switch {
+		case child.Key == "":
+			continue
+		case child.Key == "@include" && len(child.Includes) > 0:
+			for _, included := range child.Includes {
+				out = append(out, included.Root.Properties()...)
+			}
+		default:
+			out = append(out, child)
+		}
+	}
+	return out
+}
+
+// Find returns the first property with the given key whose values start
+// with the given ones (compared case-insensitively), looking into includes
+func (n *Node) Find(key string, values ...string) *Node {
+	for _, child := range n.Properties() {
+		if child.matches(key, values) {
+			return child
+		}
+	}
+	return nil
+}
+
+// FindConditional is Find for the properties inside the @if and @else blocks
+// of the block (at any nesting), which are not returned by Properties since
+// whether they apply depends on the preprocessor
+func (n *Node) FindConditional(key string, values ...string) *Node {
+	for _, child := range n.Properties() {
+		if child.Key != "@if" && child.Key != "@else" {
+			continue
+		}
+		if found := child.Find(key, values...); found != nil {
+			return found
+		}
+		if found := child.FindConditional(key, values...); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// FindAll returns every property of the block (and its sub-blocks, but not
+// included files) matching Find's criteria
+func (n *Node) FindAll(key string, values ...string) []*Node {
+	var out []*Node
+	for _, child := range n.Children {
+		if child.matches(key, values) {
+			out = append(out, child)
+		}
+		out = append(out, child.FindAll(key, values...)...)
+	}
+	return out
+}
+
+func (n *Node) matches(key string, values []string) bool {
+	if n.Key == "" || !strings.EqualFold(n.Key, key) || len(n.Values) < len(values) {
+		return false
+	}
+	for i, value := range values {
+		if !strings.EqualFold(n.Values[i], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetValues replaces the values of a property
+func (n *Node) SetValues(values ...string) {
+	n.Values = values
+	n.dirty = true
+}
+
+// SetComment replaces the comment at the end of the node's line
+func (n *Node) SetComment(comment string) {
+	if comment != "" && !strings.HasPrefix(comment, "#") {
+		comment = "# " + comment
+	}
+	n.comment = comment
+	n.dirty = true
+}
+
+// Set changes the values of the first property with the given key (even
+// if it's in an included file), adding it to the block if there is none
+func (n *Node) Set(key string, values ...string) *Node {
+	if child := n.Find(key); child != nil {
+		child.SetValues(values...)
+		return child
+	}
+	return n.Add(key, values...)
+}
+
+// Add appends a new property to the block, right after its last property
+// so that trailing blank lines and comments stay where they are
+func (n *Node) Add(key string, values ...string) *Node {
+	node := &Node{
+		Key:    key,
+		Values: values,
+		indent: n.childIndent(),
+		dirty:  true,
+	}
+
+	position := len(n.Children)
+	for position > 0 && n.Children[position-1].Key == "" {
+		position--
+	}
+	n.appendChild(node)
+	copy(n.Children[position+1:], n.Children[position:])
+	n.Children[position] = node
+
+	// The property is now a block if it wasn't already
+	if !n.IsBlock {
+		n.IsBlock = true
+		n.dirty = true
+	}
+
+	return node
+}
+
+// AddBlock is Add for properties that contain a block
+func (n *Node) AddBlock(key string, values ...string) *Node {
+	node := n.Add(key, values...)
+	node.IsBlock = true
+	return node
+}
+
+// Remove deletes the node and its block from the document
+func (n *Node) Remove() {
+	if n.parent == nil {
+		return
+	}
+	siblings := n.parent.Children
+	for i, sibling := range siblings {
+		if sibling == n {
+			n.parent.Children = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	n.parent = nil
+}
+
+// childIndent guesses the indentation of the children of a block, using
+// the existing ones if there are any
+func (n *Node) childIndent() string {
+	for _, child := range n.Children {
+		if child.Key != "" {
+			return child.indent
+		}
+	}
+	if n.parent == nil {
+		// Root block
+		return ""
+	}
+	// Use the same character the parent was indented with
+	if len(n.indent) > 0 && n.indent[0] == ' ' {
+		return n.indent + " "
+	}
+	return n.indent + "\t"
+}
+
+// String renders a node's line, unchanged nodes are written as they were read
+func (n *Node) String() string {
+	if !n.dirty {
+		return n.raw
+	}
+
+	parts := []string{n.Key}
+	for _, value := range n.Values {
+		parts = append(parts, quoteValue(value))
+	}
+	line := n.indent + strings.Join(parts, " ")
+	if n.IsBlock {
+		line += ":"
+	}
+	if n.comment != "" {
+		line += " " + n.comment
+	}
+	return line
+}
+
+// quoteValue escapes a value so that it's read back the same way
+func quoteValue(value string) string {
+	value = strings.Replace(value, "#", "\\#", -1)
+	if value == "" || strings.ContainsAny(value, " \t") {
+		return "\"" + value + "\""
+	}
+	return value
+}
+
+func (n *Node) lines(out []string) []string {
+	for _, child := range n.Children {
+		out = append(out, child.String())
+		out = child.lines(out)
+	}
+	return out
+}
+
+// String renders the document (without the included files)
+func (d *Document) String() string {
+	out := strings.Join(d.Root.lines(nil), "\n")
+	if d.finalNewline && out != "" {
+		out += "\n"
+	}
+	return out
+}
+
+// Files returns the document and every document it includes
+func (d *Document) Files() []*Document {
+	out := []*Document{d}
+	for _, include := range d.Root.FindAll("@include") {
+		for _, included := range include.Includes {
+			out = append(out, included.Files()...)
+		}
+	}
+	return out
+}
+
+// Modified returns true if saving would change the file
+func (d *Document) Modified() bool {
+	return d.String() != d.original
+}
+
+// Save writes back every file of the document that was modified
+func (d *Document) Save() error {
+	for _, file := range d.Files() {
+		if !file.Modified() {
+			continue
+		}
+		if err := file.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save replaces the file atomically, keeping its permissions
+func (d *Document) save() error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(d.Path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(d.Path), "."+filepath.Base(d.Path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	content := d.String()
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), d.Path); err != nil {
+		return err
+	}
+	d.original = content
+	return nil
+}
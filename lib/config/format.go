@@ -0,0 +1,42 @@
+package config
+
+import (
+	"io"
+	"strings"
+)
+
+// Write writes a block in the configuration syntax, so that it can be
+// parsed back (unlike Dump, which is meant for debugging)
+func (b Block) Write(out io.Writer) error {
+	return writeBlock(out, b, 0)
+}
+
+func writeBlock(out io.Writer, block Block, level int) error {
+	indent := strings.Repeat("\t", level)
+	for _, property := range block {
+		parts := []string{property.Key}
+		for _, value := range property.Values {
+			parts = append(parts, quoteValue(value))
+		}
+		line := indent + strings.Join(parts, " ")
+		if property.Block != nil {
+			line += ":"
+		}
+		if _, err := io.WriteString(out, line+"\n"); err != nil {
+			return err
+		}
+		if property.Block != nil {
+			if err := writeBlock(out, property.Block, level+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// String returns the block in the configuration syntax
+func (b Block) String() string {
+	var out strings.Builder
+	b.Write(&out)
+	return out.String()
+}
@@ -21,22 +21,7 @@ func parseConfig(path, configfile string) (Block, error) {
 	scope := []*Block{&block}
 	for lineNumber, line := range lines {
 		// Remove comments (find # without preceding \)
-		linecopy := line
-		copyoffset := 0
-		for {
-			i := strings.IndexRune(linecopy, '#')
-			if i < 0 {
-				break
-			} else if i == 0 {
-				line = ""
-				break
-			} else if linecopy[i-1] != '\\' {
-				line = line[0 : copyoffset+i-1]
-				break
-			}
-			linecopy = line[i+1:]
-			copyoffset += i + 1
-		}
+		line, _ = splitComment(line)
 
 		// Unescape escaped #
 		line = strings.Replace(line, "\\#", "#", -1)
@@ -89,6 +74,9 @@ func parseConfig(path, configfile string) (Block, error) {
 		*scope[indent] = append(*scope[indent], Property{
 			Key:    key,
 			Values: values,
+			File:   path,
+			Line:   lineNumber + 1,
+			Column: indent + 1,
 		})
 
 		// If we are a block, create it and add it to the scope
@@ -1,63 +1,292 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/hamcha/meiru/lib/errors"
 )
 
-type pScope map[string]string
-type pFunction func(scope pScope, prop Property) ([]Property, error)
+type pScope struct {
+	// Directory relative @include paths start from
+	pwd string
+
+	// Variables set with @define and @env
+	vars map[string]string
+
+	// Files currently being processed, to catch include loops
+	files []string
+}
+
+type pFunction func(scope *pScope, prop Property) ([]Property, error)
 
 var (
 	ErrSrcPreprocess errors.ErrorSource = "cfg preprocess"
 
 	PPErrorInexistantFunction = errors.NewType(ErrSrcPreprocess, "unknown preprocess directive")
 	PPErrorMissingParameter   = errors.NewType(ErrSrcPreprocess, "missing required parameter")
+	PPErrorInvalidName        = errors.NewType(ErrSrcPreprocess, "invalid variable name")
+	PPErrorInvalidCondition   = errors.NewType(ErrSrcPreprocess, "invalid condition")
+	PPErrorUnexpectedElse     = errors.NewType(ErrSrcPreprocess, "@else without a matching @if")
+	PPErrorIncludeLoop        = errors.NewType(ErrSrcPreprocess, "file includes itself")
+	PPErrorIncludeFailed      = errors.NewType(ErrSrcPreprocess, "could not include file")
+)
+
+var (
+	variableName      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	variableReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
 )
 
 func processConfig(path string, block Block) (Block, error) {
-	scope := pScope{
-		"_pwd": filepath.Dir(path),
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := &pScope{
+		pwd:   filepath.Dir(path),
+		vars:  make(map[string]string),
+		files: []string{abspath},
 	}
+	return processBlock(scope, block)
+}
 
+// processBlock runs the directives in a block and in all the blocks under it.
+// Variables defined in a nested block are only visible inside it.
+func processBlock(scope *pScope, block Block) (Block, error) {
 	var out Block
+
+	// Whether the last @if at this level was taken, nil if the previous
+	// property was not an @if
+	var lastIf *bool
+
 	for _, property := range block {
-		if property.Key[0] == '@' {
-			var function pFunction
-			switch property.Key[1:] {
-			case "include":
-				function = pInclude
-			default:
-				return out, errors.NewError(PPErrorInexistantFunction).WithInfo("File <%s>", path)
-			}
-			result, err := function(scope, property)
-			if err != nil {
-				return out, err
+		property.Values = scope.expand(property.Values)
+
+		if property.Key[0] != '@' {
+			lastIf = nil
+			if property.Block != nil {
+				inner, err := processBlock(scope.child(), property.Block)
+				if err != nil {
+					return out, err
+				}
+				property.Block = inner
 			}
-			out = append(out, result...)
-		} else {
 			out = append(out, property)
+			continue
+		}
+
+		// Conditionals decide which block gets merged in this one
+		switch property.Key[1:] {
+		case "if", "else":
+			var taken bool
+			if property.Key == "@if" {
+				var err error
+				taken, err = pCondition(scope, property)
+				if err != nil {
+					return out, err
+				}
+				lastIf = &taken
+			} else {
+				if lastIf == nil {
+					return out, errors.NewError(PPErrorUnexpectedElse).WithInfo("%s: %s", property.Position(), property.Key)
+				}
+				taken = !*lastIf
+				lastIf = nil
+			}
+			if taken {
+				inner, err := processBlock(scope, property.Block)
+				if err != nil {
+					return out, err
+				}
+				out = append(out, inner...)
+			}
+			continue
 		}
+		lastIf = nil
+
+		var function pFunction
+		switch property.Key[1:] {
+		case "include":
+			function = pInclude
+		case "define":
+			function = pDefine
+		case "env":
+			function = pEnv
+		default:
+			return out, errors.NewError(PPErrorInexistantFunction).WithInfo("%s: %s", property.Position(), property.Key)
+		}
+		result, err := function(scope, property)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, result...)
 	}
 
 	return out, nil
 }
 
-func pInclude(scope pScope, prop Property) ([]Property, error) {
+// child returns a scope for a nested block, which can't change the
+// variables of its parent
+func (scope *pScope) child() *pScope {
+	vars := make(map[string]string, len(scope.vars))
+	for name, value := range scope.vars {
+		vars[name] = value
+	}
+	return &pScope{
+		pwd:   scope.pwd,
+		vars:  vars,
+		files: scope.files,
+	}
+}
+
+// expand replaces ${NAME} with the value of defined variables, unknown ones
+// (like ${domain} and ${user} in box paths) are left as they are
+func (scope *pScope) expand(values []string) []string {
+	if len(scope.vars) < 1 || len(values) < 1 {
+		return values
+	}
+
+	out := make([]string, len(values))
+	for i, value := range values {
+		out[i] = variableReference.ReplaceAllStringFunc(value, func(ref string) string {
+			if value, ok := scope.vars[ref[2:len(ref)-1]]; ok {
+				return value
+			}
+			return ref
+		})
+	}
+	return out
+}
+
+func checkName(prop Property) (string, error) {
 	if len(prop.Values) < 1 {
-		return nil, errors.NewError(PPErrorMissingParameter)
+		return "", errors.NewError(PPErrorMissingParameter).WithInfo("%s: %s", prop.Position(), prop.Key)
+	}
+	name := prop.Values[0]
+	if !variableName.MatchString(name) {
+		return "", errors.NewError(PPErrorInvalidName).WithInfo("%s: '%s' (use letters, digits and _)", prop.Position(), name)
+	}
+	return name, nil
+}
+
+// pDefine sets a variable: @define NAME value...
+func pDefine(scope *pScope, prop Property) ([]Property, error) {
+	name, err := checkName(prop)
+	if err != nil {
+		return nil, err
+	}
+	scope.vars[name] = strings.Join(prop.Values[1:], " ")
+	return nil, nil
+}
+
+// pEnv sets a variable from the environment: @env NAME [default...]
+// If NAME is not in the environment and there is no default, the variable
+// stays undefined
+func pEnv(scope *pScope, prop Property) ([]Property, error) {
+	name, err := checkName(prop)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		scope.vars[name] = value
+	} else if len(prop.Values) > 1 {
+		scope.vars[name] = strings.Join(prop.Values[1:], " ")
+	}
+	return nil, nil
+}
+
+// pCondition evaluates the condition of an @if, which is one of:
+//
+//	@if NAME             NAME is defined and not empty
+//	@if !NAME            NAME is undefined or empty
+//	@if ${NAME} = value  (or !=) compares two values
+func pCondition(scope *pScope, prop Property) (bool, error) {
+	switch len(prop.Values) {
+	case 1:
+		name := prop.Values[0]
+		negate := strings.HasPrefix(name, "!")
+		if negate {
+			name = name[1:]
+		}
+		if !variableName.MatchString(name) {
+			return false, errors.NewError(PPErrorInvalidName).WithInfo("%s: '%s' (use letters, digits and _)", prop.Position(), name)
+		}
+		return (scope.vars[name] != "") != negate, nil
+	case 3:
+		switch prop.Values[1] {
+		case "=", "==":
+			return prop.Values[0] == prop.Values[2], nil
+		case "!=":
+			return prop.Values[0] != prop.Values[2], nil
+		}
+	}
+	return false, errors.NewError(PPErrorInvalidCondition).WithInfo("%s: use '@if NAME', '@if !NAME' or '@if <value> = <value>'", prop.Position())
+}
+
+// pInclude merges other files in place: @include path... (glob patterns
+// like domains/*.conf are accepted, and can match no file at all)
+func pInclude(scope *pScope, prop Property) ([]Property, error) {
+	if len(prop.Values) < 1 {
+		return nil, errors.NewError(PPErrorMissingParameter).WithInfo("%s: %s", prop.Position(), prop.Key)
 	}
 
 	var props []Property
 	for _, val := range prop.Values {
-		path := filepath.Clean(filepath.Join(scope["_pwd"], val))
-		cfg, err := LoadConfig(path)
+		files, err := includedFiles(scope.pwd, val)
 		if err != nil {
-			return nil, err
+			return nil, errors.NewError(PPErrorIncludeFailed).WithError(err).WithInfo("%s: %s", prop.Position(), val)
+		}
+
+		for _, path := range files {
+			abspath, err := filepath.Abs(path)
+			if err != nil {
+				return nil, errors.NewError(PPErrorIncludeFailed).WithError(err).WithInfo("%s: %s", prop.Position(), val)
+			}
+			for _, parent := range scope.files {
+				if parent == abspath {
+					return nil, errors.NewError(PPErrorIncludeLoop).WithInfo("%s: %s", prop.Position(), path)
+				}
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, errors.NewError(PPErrorIncludeFailed).WithError(err).WithInfo("%s: %s", prop.Position(), val)
+			}
+			block, err := parseConfig(path, string(data))
+			if err != nil {
+				return nil, err
+			}
+
+			// Included files share variables with the file including them
+			included := &pScope{
+				pwd:   filepath.Dir(path),
+				vars:  scope.vars,
+				files: append(append([]string(nil), scope.files...), abspath),
+			}
+			block, err = processBlock(included, block)
+			if err != nil {
+				return nil, err
+			}
+			props = append(props, block...)
 		}
-		props = append(props, cfg.Data...)
 	}
 
 	return props, nil
 }
+
+// includedFiles resolves an @include path relative to the including file,
+// expanding glob patterns (matches are sorted by name)
+func includedFiles(pwd string, path string) ([]string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(pwd, path)
+	}
+
+	if !strings.ContainsAny(path, "*?[") {
+		return []string{path}, nil
+	}
+	return filepath.Glob(path)
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -11,20 +13,57 @@ var (
 	ErrSrcQuery errors.ErrorSource = "query"
 
 	QueryErrInvalidParamConstraint = errors.NewType(ErrSrcQuery, "invalid param constraint")
+	QueryErrInvalidPattern         = errors.NewType(ErrSrcQuery, "invalid pattern")
 	QueryErrSingleNonNumFilter     = errors.NewType(ErrSrcQuery, "non numeric single filter")
 	QueryErrSingleTooFewResults    = errors.NewType(ErrSrcQuery, "too few results")
 	QueryErrSingleTooFewValues     = errors.NewType(ErrSrcQuery, "too few values")
+	QueryErrInvalidValue           = errors.NewType(ErrSrcQuery, "invalid value")
+	QueryErrInvalidTarget          = errors.NewType(ErrSrcQuery, "decode target must be a pointer to a struct")
+	QueryErrUnsupportedField       = errors.NewType(ErrSrcQuery, "unsupported field type")
 )
 
 type QueryResult []Property
 
+// Query returns all properties matching a path, in the order they appear in.
+// A path is a list of space separated keys, each one a level deeper than the
+// previous, like "domain user password". Keys can be:
+//
+//	name        a property called "name"
+//	na*e        any property matching a glob pattern, "*" alone matches all
+//	**          any number of levels (including none), ex. "** password"
+//
+// Each key can be followed by a colon and comma separated constraints:
+//
+//	N=value     the Nth value is exactly "value"
+//	N^=value    the Nth value is "value", ignoring case
+//	N~=regex    the Nth value matches a regular expression
+//	*=value     any value matches (with any of the operators above)
+//	name        the property's block contains a "name" property
+//	**name      the property's block contains a "name" property at any depth
+//
+// Constraints starting with "!" are negated. Values can be quoted when they
+// contain spaces, commas or "=", ex. domain:0^=example.com user:!0="a b",
+// use QuoteQueryValue when building queries from untrusted input.
 func (cfg Config) Query(path string) (QueryResult, *errors.Error) {
 	return cfg.QuerySub(path, cfg.Data)
 }
 
 func (cfg Config) QuerySub(path string, start Block) (QueryResult, *errors.Error) {
-	parts := strings.Split(path, " ")
-	return queryPath(parts, start)
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return queryPath(segments, start), nil
+}
+
+// Position returns where the first property matching a query was defined,
+// empty if there is none
+func (cfg Config) Position(path string) string {
+	results, err := cfg.Query(path)
+	if err != nil || len(results) < 1 {
+		return ""
+	}
+	return results[0].Position()
 }
 
 func (cfg Config) QuerySingle(path string) (string, *errors.Error) {
@@ -32,13 +71,19 @@ func (cfg Config) QuerySingle(path string) (string, *errors.Error) {
 }
 
 func (cfg Config) QuerySingleSub(path string, start Block) (string, *errors.Error) {
+	value, _, err := cfg.querySingle(path, start)
+	return value, err
+}
+
+// querySingle is QuerySingleSub, also returning the property the value is from
+func (cfg Config) querySingle(path string, start Block) (string, Property, *errors.Error) {
 	// Separate between generic and specific part
 	sep := strings.LastIndexByte(path, ' ')
 
 	// Call query on generic path
 	results, err := cfg.QuerySub(path[:sep], start)
 	if err != nil {
-		return "", err
+		return "", Property{}, err
 	}
 
 	//
@@ -53,18 +98,18 @@ func (cfg Config) QuerySingleSub(path string, start Block) (string, *errors.Erro
 		var err error
 		paramID, err = strconv.Atoi(parts[0])
 		if err != nil {
-			return "", errors.NewError(QueryErrSingleNonNumFilter).WithError(err)
+			return "", Property{}, errors.NewError(QueryErrSingleNonNumFilter).WithError(err)
 		}
 	} else {
 		// "n:m" will the be the Mth value of the Nth result
 		var err error
 		resultID, err = strconv.Atoi(parts[0])
 		if err != nil {
-			return "", errors.NewError(QueryErrSingleNonNumFilter).WithError(err)
+			return "", Property{}, errors.NewError(QueryErrSingleNonNumFilter).WithError(err)
 		}
 		paramID, err = strconv.Atoi(parts[1])
 		if err != nil {
-			return "", errors.NewError(QueryErrSingleNonNumFilter).WithError(err)
+			return "", Property{}, errors.NewError(QueryErrSingleNonNumFilter).WithError(err)
 		}
 	}
 
@@ -74,135 +119,282 @@ func (cfg Config) QuerySingleSub(path string, start Block) (string, *errors.Erro
 
 	// Check for out of bound errors
 	if resultID >= len(results) {
-		return "", errors.NewError(QueryErrSingleTooFewResults)
+		return "", Property{}, errors.NewError(QueryErrSingleTooFewResults).WithInfo("Path: %s", path)
 	}
 	if paramID >= len(results[resultID].Values) {
-		return "", errors.NewError(QueryErrSingleTooFewValues)
+		return "", results[resultID], errors.NewError(QueryErrSingleTooFewValues).WithInfo("%s: %s", results[resultID].Position(), path)
 	}
 
-	return results[resultID].Values[paramID], nil
+	return results[resultID].Values[paramID], results[resultID], nil
+}
+
+// segment is a single key of a query path
+type segment struct {
+	Key         string
+	Descendants bool
+	Constraints []constraint
 }
 
 type constraint struct {
-	ParamID int
-	Value   string
+	Negate bool
+
+	// Value constraints, ParamID is -1 when any value can match
+	ParamID  int
+	Operator string
+	Value    string
+	Pattern  *regexp.Regexp
+
+	// Block key constraints (Key is set and Operator is empty)
+	Key  string
+	Deep bool
 }
 
-func queryPath(path []string, block Block) ([]Property, *errors.Error) {
-	var found []Property
+func parsePath(str string) ([]segment, *errors.Error) {
+	var segments []segment
+	for _, part := range splitUnquoted(str, ' ') {
+		// Consecutive "**" would only return the same results multiple times
+		if part == "**" && len(segments) > 0 && segments[len(segments)-1].Descendants {
+			continue
+		}
 
-	if len(path) == 1 {
-		// Already at leaf nodes, only fetch matching
-		for _, property := range block {
-			isOk, err := verifyConstraints(path[0], property)
-			if err != nil {
-				return found, err
+		parts := strings.SplitN(part, ":", 2)
+		current := segment{
+			Key:         parts[0],
+			Descendants: parts[0] == "**",
+		}
+		if len(parts) > 1 {
+			if current.Descendants {
+				return nil, errors.NewError(QueryErrInvalidParamConstraint).WithInfo("'**' cannot have constraints: %s", part)
 			}
-			if isOk {
-				found = append(found, property)
+			var err *errors.Error
+			current.Constraints, err = getConstraintList(parts[1])
+			if err != nil {
+				return nil, err
 			}
 		}
-	} else {
-		// Root or middle nodes, recurse to matching leaves
-		for _, property := range block {
-			if property.Block != nil {
-				isOk, err := verifyConstraints(path[0], property)
-				if err != nil {
-					return found, err
-				}
-				if isOk {
-					items, err := queryPath(path[1:], property.Block)
-					if err != nil {
-						return found, err
-					}
-
-					found = append(found, items...)
-				}
-			}
+		segments = append(segments, current)
+	}
+	return segments, nil
+}
+
+// splitUnquoted splits a string on a separator, ignoring the ones in quotes
+func splitUnquoted(str string, sep byte) []string {
+	var parts []string
+	for {
+		index := indexUnquoted(str, sep)
+		if index < 0 {
+			return append(parts, str)
 		}
+		parts = append(parts, str[:index])
+		str = str[index+1:]
 	}
+}
 
-	return found, nil
+// indexUnquoted returns the index of the first separator outside of quotes,
+// or -1 if there is none
+func indexUnquoted(str string, sep byte) int {
+	insideQuotes := false
+	for i := 0; i < len(str); i++ {
+		switch {
+		case insideQuotes && str[i] == '\\':
+			// Skip escaped character
+			i++
+		case str[i] == '"':
+			insideQuotes = !insideQuotes
+		case str[i] == sep && !insideQuotes:
+			return i
+		}
+	}
+	return -1
 }
 
 func getConstraintList(str string) ([]constraint, *errors.Error) {
 	var list []constraint
+	for _, item := range splitUnquoted(str, ',') {
+		// Allow a trailing comma
+		if item == "" {
+			continue
+		}
 
-	// Add query constraint terminator if not present
-	if !strings.HasSuffix(str, ",") {
-		str += ","
-	}
+		current := constraint{}
+		if strings.HasPrefix(item, "!") {
+			current.Negate = true
+			item = item[1:]
+		}
 
-	// Iterate through string to find constraints
-	currentConstraint := constraint{}
-	firstChar := 0
-	trimQuotes := false
-	insideQuotes := false
-	for i, chr := range str {
-		switch chr {
-		case '"':
-			trimQuotes = true
-			if i > 0 && str[i-1] != '\\' {
-				insideQuotes = !insideQuotes
+		// Find the operator, if any, outside of quotes
+		opIndex := indexUnquoted(item, '=')
+
+		// No operator means a block key constraint
+		if opIndex < 0 {
+			current.Key = item
+			if strings.HasPrefix(item, "**") {
+				current.Key = item[2:]
+				current.Deep = true
 			}
-		case ',':
-			if insideQuotes {
-				continue
+			if current.Key == "" {
+				return list, errors.NewError(QueryErrInvalidParamConstraint).WithInfo("Empty key constraint")
 			}
+			list = append(list, current)
+			continue
+		}
 
-			currentConstraint.Value = str[firstChar:i]
-
-			if trimQuotes {
-				currentConstraint.Value = strings.Trim(currentConstraint.Value, "\"")
-			}
+		param := item[:opIndex]
+		current.Operator = "="
+		if strings.HasSuffix(param, "^") || strings.HasSuffix(param, "~") {
+			current.Operator = param[len(param)-1:] + "="
+			param = param[:len(param)-1]
+		}
 
-			list = append(list, currentConstraint)
-		case '=':
-			if insideQuotes {
-				continue
+		// Get param id
+		if param == "*" {
+			current.ParamID = -1
+		} else {
+			num, err := strconv.Atoi(param)
+			if err != nil || num < 0 {
+				return list, errors.NewError(QueryErrInvalidParamConstraint).WithError(err).WithInfo("Constraint: %s", item)
 			}
+			current.ParamID = num
+		}
 
-			// Get param id
-			num, err := strconv.Atoi(str[firstChar:i])
+		current.Value = unquote(item[opIndex+1:])
+		if current.Operator == "~=" {
+			pattern, err := regexp.Compile(current.Value)
 			if err != nil {
-				return list, errors.NewError(QueryErrInvalidParamConstraint).WithError(err)
+				return list, errors.NewError(QueryErrInvalidPattern).WithError(err)
 			}
-
-			currentConstraint.ParamID = num
-			firstChar = i + 1
-			trimQuotes = false
+			current.Pattern = pattern
 		}
+
+		list = append(list, current)
 	}
 
 	return list, nil
 }
 
-func verifyConstraints(path string, property Property) (bool, *errors.Error) {
-	parts := strings.SplitN(path, ":", 2)
-	pathname := parts[0]
+// QuoteQueryValue quotes a value so it can be safely used in a query
+// constraint, no matter what characters it contains
+func QuoteQueryValue(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return "\"" + value + "\""
+}
 
-	// Parse constraints if any
-	var constraints []constraint
-	if len(parts) > 1 {
-		var err *errors.Error
-		constraints, err = getConstraintList(parts[1])
-		if err != nil {
-			return false, err
+// unquote removes the quotes around a constraint value, if any
+func unquote(str string) string {
+	if len(str) < 2 || str[0] != '"' || str[len(str)-1] != '"' {
+		return str
+	}
+
+	var out strings.Builder
+	str = str[1 : len(str)-1]
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+1 < len(str) {
+			i++
+		}
+		out.WriteByte(str[i])
+	}
+	return out.String()
+}
+
+func queryPath(path []segment, block Block) []Property {
+	var found []Property
+
+	// "**" is also tried against every block below this one
+	if path[0].Descendants {
+		for _, property := range block {
+			if len(path) == 1 {
+				found = append(found, property)
+			} else {
+				found = append(found, queryProperty(path[1:], property)...)
+			}
+			if property.Block != nil {
+				found = append(found, queryPath(path, property.Block)...)
+			}
+		}
+		return found
+	}
+
+	for _, property := range block {
+		found = append(found, queryProperty(path, property)...)
+	}
+	return found
+}
+
+// queryProperty returns the properties matching a path starting from (and
+// including) a property
+func queryProperty(path []segment, property Property) []Property {
+	if !path[0].matches(property) {
+		return nil
+	}
+
+	// Already at leaf nodes
+	if len(path) == 1 {
+		return []Property{property}
+	}
+
+	// Root or middle nodes, recurse to matching leaves
+	if property.Block == nil {
+		return nil
+	}
+	return queryPath(path[1:], property.Block)
+}
+
+func (seg segment) matches(property Property) bool {
+	if !matchKey(seg.Key, property.Key) {
+		return false
+	}
+	for _, constraint := range seg.Constraints {
+		if constraint.matches(property) == constraint.Negate {
+			return false
 		}
 	}
+	return true
+}
 
-	// Check path
-	if pathname != property.Key {
-		return false, nil
+func matchKey(pattern string, key string) bool {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return pattern == key
 	}
+	ok, _ := path.Match(pattern, key)
+	return ok
+}
 
-	// Check constraints
-	numvals := len(property.Values)
-	for _, constraint := range constraints {
-		if constraint.ParamID >= numvals || property.Values[constraint.ParamID] != constraint.Value {
-			return false, nil
+// matches checks a constraint against a property, ignoring negation
+func (c constraint) matches(property Property) bool {
+	if c.Operator == "" {
+		return hasKey(property.Block, c.Key, c.Deep)
+	}
+
+	if c.ParamID >= 0 {
+		return c.ParamID < len(property.Values) && c.matchValue(property.Values[c.ParamID])
+	}
+	for _, value := range property.Values {
+		if c.matchValue(value) {
+			return true
 		}
 	}
+	return false
+}
+
+func (c constraint) matchValue(value string) bool {
+	switch c.Operator {
+	case "^=":
+		return strings.EqualFold(value, c.Value)
+	case "~=":
+		return c.Pattern.MatchString(value)
+	}
+	return value == c.Value
+}
 
-	return true, nil
+func hasKey(block Block, key string, deep bool) bool {
+	for _, property := range block {
+		if matchKey(key, property.Key) {
+			return true
+		}
+		if deep && hasKey(property.Block, key, deep) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+const queryTestConfig = `
+domain example.com:
+	catchall admin
+	user admin:
+		password x
+	user "John Doe":
+		password y
+		alias:
+			name jd
+domain Example.ORG:
+	user bob
+	user "a,b=c"
+smtp:
+	listen :25 :587
+	tls:
+		cert a.pem
+`
+
+func loadQueryTestConfig(t *testing.T) Config {
+	block, err := parseConfig("test.conf", queryTestConfig)
+	if err != nil {
+		t.Fatalf("could not parse test config: %s", err.Error())
+	}
+	return Config{Data: block}
+}
+
+// describe renders properties as "key value..." for easy comparison
+func describe(results QueryResult) []string {
+	var out []string
+	for _, property := range results {
+		out = append(out, strings.Join(append([]string{property.Key}, property.Values...), " "))
+	}
+	return out
+}
+
+func TestQuery(t *testing.T) {
+	cfg := loadQueryTestConfig(t)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"exact path", "domain user password", []string{"password x", "password y"}},
+		{"exact path, no match", "domain password", nil},
+
+		{"wildcard key", "domain *", []string{"catchall admin", "user admin", "user John Doe", "user bob", "user a,b=c"}},
+		{"glob key", "domain us?r", []string{"user admin", "user John Doe", "user bob", "user a,b=c"}},
+		{"glob key, no match", "domain x*", nil},
+
+		{"descendants, zero levels", "** domain", []string{"domain example.com", "domain Example.ORG"}},
+		{"descendants, many levels", "** name", []string{"name jd"}},
+		{"descendants in the middle", "domain ** password", []string{"password x", "password y"}},
+		{"descendants, no match", "** nothing", nil},
+		{"consecutive descendants", "** ** password", []string{"password x", "password y"}},
+
+		{"exact value", "domain:0=example.com user:0=admin", []string{"user admin"}},
+		{"exact value is case sensitive", "domain:0=EXAMPLE.COM", nil},
+		{"case insensitive value", "domain:0^=example.org user", []string{"user bob", "user a,b=c"}},
+		{"case insensitive value, no match", "domain:0^=example.net", nil},
+		{"regex value", `domain:0~=\.com$`, []string{"domain example.com"}},
+		{"regex value, no match", "domain:0~=^foo", nil},
+		{"any value", "smtp listen:*=:587", []string{"listen :25 :587"}},
+		{"any value, no match", "smtp listen:*=:110", nil},
+		{"any value, case insensitive", "domain:*^=EXAMPLE.COM", []string{"domain example.com"}},
+		{"any value, regex", "smtp listen:*~=^:5", []string{"listen :25 :587"}},
+
+		{"negated value", "domain user:!0=admin", []string{"user John Doe", "user bob", "user a,b=c"}},
+		{"negated value, no match", "domain:!0~=(?i)^example", nil},
+		{"value on missing index", "domain user:1=x", nil},
+		{"negated value on missing index", "domain user:!1=x", []string{"user admin", "user John Doe", "user bob", "user a,b=c"}},
+
+		{"block key", "domain user:password", []string{"user admin", "user John Doe"}},
+		{"block key glob", "domain user:pass*", []string{"user admin", "user John Doe"}},
+		{"negated block key", "domain user:!password", []string{"user bob", "user a,b=c"}},
+		{"block key is not deep", "domain:name", nil},
+		{"deep block key", "domain:**name", []string{"domain example.com"}},
+		{"negated deep block key", "domain:!**name", []string{"domain Example.ORG"}},
+
+		{"multiple constraints", "domain user:password,0^=ADMIN", []string{"user admin"}},
+		{"multiple constraints, no match", "domain user:password,0=bob", nil},
+		{"quoted value with spaces", `domain user:0="John Doe" password`, []string{"password y"}},
+		{"quoted value with comma and equals", `domain user:0="a,b=c"`, []string{"user a,b=c"}},
+		{"quoted value in regex", `domain user:0~="^a,b"`, []string{"user a,b=c"}},
+	}
+
+	for _, test := range tests {
+		results, err := cfg.Query(test.query)
+		if err != nil {
+			t.Errorf("%s: query %q returned error: %s", test.name, test.query, err.Error())
+			continue
+		}
+		if got := describe(results); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: query %q\n\tgot:  %q\n\twant: %q", test.name, test.query, got, test.want)
+		}
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	cfg := loadQueryTestConfig(t)
+
+	tests := []struct {
+		name  string
+		query string
+		want  *errors.ErrorType
+	}{
+		{"invalid regex", "domain:0~=[", QueryErrInvalidPattern},
+		{"non numeric index", "domain:a=1", QueryErrInvalidParamConstraint},
+		{"negative index", "domain:-1=1", QueryErrInvalidParamConstraint},
+		{"unquoted comma", "domain user:0=a,b=c", QueryErrInvalidParamConstraint},
+		{"empty key constraint", "domain:!", QueryErrInvalidParamConstraint},
+		{"constraints on descendants", "**:0=a", QueryErrInvalidParamConstraint},
+	}
+
+	for _, test := range tests {
+		_, err := cfg.Query(test.query)
+		if err == nil {
+			t.Errorf("%s: query %q should have failed", test.name, test.query)
+			continue
+		}
+		if err.Type != test.want {
+			t.Errorf("%s: query %q\n\tgot:  %s\n\twant: %s", test.name, test.query, err.Type.Message, test.want.Message)
+		}
+	}
+}
+
+func TestQuoteQueryValue(t *testing.T) {
+	values := []string{
+		"plain",
+		"",
+		"John Doe",
+		"a,b=c",
+		`say "hi"`,
+		`back\slash`,
+		`trailing\`,
+		`\"`,
+		"!0=x",
+		"**",
+	}
+
+	for _, value := range values {
+		cfg := Config{Data: Block{
+			{Key: "user", Values: []string{"other"}},
+			{Key: "user", Values: []string{value}},
+		}}
+
+		query := "user:0=" + QuoteQueryValue(value)
+		results, err := cfg.Query(query)
+		if err != nil {
+			t.Errorf("value %q: query %q returned error: %s", value, query, err.Error())
+			continue
+		}
+		if len(results) != 1 || results[0].Values[0] != value {
+			t.Errorf("value %q: query %q got %q", value, query, describe(results))
+		}
+
+		// A quoted value must not match anything else either
+		query = "user:!0=" + QuoteQueryValue(value)
+		results, err = cfg.Query(query)
+		if err != nil {
+			t.Errorf("value %q: query %q returned error: %s", value, query, err.Error())
+			continue
+		}
+		if got := describe(results); !reflect.DeepEqual(got, []string{"user other"}) {
+			t.Errorf("value %q: query %q got %q", value, query, got)
+		}
+	}
+}
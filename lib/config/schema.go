@@ -0,0 +1,281 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ValueType is the expected type of a property value
+type ValueType int
+
+const (
+	TypeString ValueType = iota
+	TypeInt
+	TypeBool
+	TypeSize
+	TypeDuration
+	TypePath
+	TypeAddress
+	TypeEnum
+)
+
+// Value describes a single property value
+type Value struct {
+	Type ValueType
+
+	// Allowed values for TypeEnum (case-insensitive)
+	Enum []string
+}
+
+// Shorthands for schema definitions
+var (
+	String   = Value{Type: TypeString}
+	Int      = Value{Type: TypeInt}
+	Bool     = Value{Type: TypeBool}
+	Size     = Value{Type: TypeSize}
+	Duration = Value{Type: TypeDuration}
+	Path     = Value{Type: TypePath}
+	Address  = Value{Type: TypeAddress}
+)
+
+// Enum is a value that must be one of the given choices
+func Enum(choices ...string) Value {
+	return Value{Type: TypeEnum, Enum: choices}
+}
+
+// Rule describes a property allowed by a schema
+type Rule struct {
+	Key string
+
+	// Values in order, the last one can repeat if Variadic is set.
+	// Values after the first Required ones are optional.
+	Values   []Value
+	Required int
+	Variadic bool
+
+	// Allowed properties inside the block (nil if it can't have one)
+	Block Schema
+
+	// Whether the property must be present and may appear only once
+	Mandatory bool
+	Unique    bool
+}
+
+// Schema is the list of properties allowed in a block
+type Schema []Rule
+
+// Issue is a problem found while validating a configuration
+type Issue struct {
+	Property Property
+	Warning  bool
+	Message  string
+}
+
+func (i Issue) String() string {
+	level := "error"
+	if i.Warning {
+		level = "warning"
+	}
+	position := "config"
+	if i.Property.File != "" {
+		position = i.Property.Position()
+	}
+	return fmt.Sprintf("%s: %s: %s", position, level, i.Message)
+}
+
+// Validate checks a configuration against a schema. Unknown keys are
+// reported as warnings, everything else that doesn't match is an error.
+func (cfg Config) Validate(schema Schema) []Issue {
+	return validateBlock(cfg.Data, schema, Property{}, "")
+}
+
+// HasErrors returns true if any issue is not just a warning
+func HasErrors(issues []Issue) bool {
+	for _, issue := range issues {
+		if !issue.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+func validateBlock(block Block, schema Schema, parent Property, path string) []Issue {
+	var issues []Issue
+	seen := make(map[string]Property)
+
+	for _, property := range block {
+		// Preprocessor directives are not part of the schema
+		if strings.HasPrefix(property.Key, "@") {
+			continue
+		}
+
+		name := path + property.Key
+		rule, ok := schema.find(property.Key)
+		if !ok {
+			message := fmt.Sprintf("unknown key '%s'", name)
+			if suggestion := schema.suggest(property.Key); suggestion != "" {
+				message += fmt.Sprintf(", did you mean '%s'?", path+suggestion)
+			}
+			issues = append(issues, Issue{Property: property, Warning: true, Message: message})
+			continue
+		}
+
+		if first, ok := seen[property.Key]; ok && rule.Unique {
+			issues = append(issues, Issue{Property: property, Message: fmt.Sprintf("'%s' is already defined at %s", name, first.Position())})
+		}
+		seen[property.Key] = property
+
+		issues = append(issues, validateValues(property, rule, name)...)
+
+		if property.Block != nil {
+			if rule.Block == nil {
+				issues = append(issues, Issue{Property: property, Message: fmt.Sprintf("'%s' cannot contain a block", name)})
+				continue
+			}
+			issues = append(issues, validateBlock(property.Block, rule.Block, property, name+".")...)
+		}
+	}
+
+	for _, rule := range schema {
+		if _, ok := seen[rule.Key]; rule.Mandatory && !ok {
+			where := "configuration"
+			if path != "" {
+				where = "'" + strings.TrimSuffix(path, ".") + "' block"
+			}
+			issues = append(issues, Issue{Property: parent, Message: fmt.Sprintf("required key '%s' is missing from the %s", path+rule.Key, where)})
+		}
+	}
+
+	return issues
+}
+
+func validateValues(property Property, rule Rule, name string) []Issue {
+	var issues []Issue
+	count := len(property.Values)
+
+	if count < rule.Required {
+		return []Issue{{Property: property, Message: fmt.Sprintf("'%s' needs at least %d value(s), found %d", name, rule.Required, count)}}
+	}
+	if !rule.Variadic && count > len(rule.Values) {
+		return []Issue{{Property: property, Message: fmt.Sprintf("'%s' takes at most %d value(s), found %d", name, len(rule.Values), count)}}
+	}
+
+	for i, value := range property.Values {
+		spec := rule.Values[len(rule.Values)-1]
+		if i < len(rule.Values) {
+			spec = rule.Values[i]
+		}
+		if message, warning := checkValue(value, spec); message != "" {
+			issues = append(issues, Issue{Property: property, Warning: warning, Message: fmt.Sprintf("value %d of '%s': %s", i+1, name, message)})
+		}
+	}
+
+	return issues
+}
+
+// checkValue returns a description of what is wrong with a value, if
+// anything, and whether it's just a warning
+func checkValue(value string, spec Value) (string, bool) {
+	switch spec.Type {
+	case TypeInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Sprintf("'%s' is not a number", value), false
+		}
+	case TypeBool:
+		if _, err := ParseBool(value); err != nil {
+			return fmt.Sprintf("'%s' is not on or off", value), false
+		}
+	case TypeSize:
+		if _, err := ParseByteSize(value); err != nil {
+			return fmt.Sprintf("'%s' is not a size (eg. 512K, 10M, 1G)", value), false
+		}
+	case TypeDuration:
+		if _, err := ParseDuration(value); err != nil {
+			return fmt.Sprintf("'%s' is not a duration (eg. 30s, 5m, 1h)", value), false
+		}
+	case TypeAddress:
+		if _, err := ParseAddr(value); err != nil {
+			return fmt.Sprintf("'%s' is not an address (host or host:port)", value), false
+		}
+	case TypePath:
+		// Paths with placeholders are only known at runtime
+		if !strings.Contains(value, "${") {
+			if _, err := os.Stat(value); err != nil {
+				return fmt.Sprintf("'%s' does not exist", value), true
+			}
+		}
+	case TypeEnum:
+		for _, choice := range spec.Enum {
+			if strings.EqualFold(choice, value) {
+				return "", false
+			}
+		}
+		return fmt.Sprintf("'%s' is not one of: %s", value, strings.Join(spec.Enum, ", ")), false
+	}
+	return "", false
+}
+
+func (s Schema) find(key string) (Rule, bool) {
+	for _, rule := range s {
+		if rule.Key == key {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// suggest finds the allowed key closest to an unknown one
+func (s Schema) suggest(key string) string {
+	best, bestDistance := "", -1
+	for _, rule := range s {
+		distance := editDistance(strings.ToLower(key), strings.ToLower(rule.Key))
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = rule.Key, distance
+		}
+	}
+
+	// Only suggest keys that are reasonably close
+	if bestDistance < 0 || bestDistance > 2 || bestDistance >= len(key) {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the optimal string alignment distance between two
+// strings (Levenshtein distance where swapping two letters counts as one)
+func editDistance(a, b string) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			rows[i][j] = minInt(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				rows[i][j] = minInt(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return rows[len(a)][len(b)]
+}
+
+func minInt(first int, others ...int) int {
+	for _, other := range others {
+		if other < first {
+			first = other
+		}
+	}
+	return first
+}
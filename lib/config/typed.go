@@ -0,0 +1,93 @@
+package config
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+// IsMissing returns true if a query failed only because nothing matched it,
+// which usually means a default should be used instead
+func IsMissing(err *errors.Error) bool {
+	return err != nil && err.Type == QueryErrSingleTooFewResults
+}
+
+// queryTyped runs a single value query and converts the result, errors
+// point to where the offending value was defined
+func (cfg Config) queryTyped(path string, convert func(string) error) *errors.Error {
+	value, property, err := cfg.querySingle(path, cfg.Data)
+	if err != nil {
+		return err
+	}
+	if converr := convert(value); converr != nil {
+		return invalidValue(property, value, converr)
+	}
+	return nil
+}
+
+func invalidValue(property Property, value string, err error) *errors.Error {
+	return errors.NewError(QueryErrInvalidValue).WithError(err).WithInfo("%s: '%s' is not a valid value for '%s'", property.Position(), value, property.Key)
+}
+
+// QueryInt returns a single value as an integer
+func (cfg Config) QueryInt(path string) (int, *errors.Error) {
+	var num int
+	err := cfg.queryTyped(path, func(value string) (err error) {
+		num, err = strconv.Atoi(value)
+		return
+	})
+	return num, err
+}
+
+// QueryBool returns a single on/off value as a boolean
+func (cfg Config) QueryBool(path string) (bool, *errors.Error) {
+	var flag bool
+	err := cfg.queryTyped(path, func(value string) (err error) {
+		flag, err = ParseBool(value)
+		return
+	})
+	return flag, err
+}
+
+// QueryDuration returns a single value as a duration (ex. "30s")
+func (cfg Config) QueryDuration(path string) (time.Duration, *errors.Error) {
+	var duration time.Duration
+	err := cfg.queryTyped(path, func(value string) (err error) {
+		duration, err = ParseDuration(value)
+		return
+	})
+	return duration, err
+}
+
+// QueryBytes returns a single value as a byte count (ex. "10M")
+func (cfg Config) QueryBytes(path string) (uint64, *errors.Error) {
+	var size uint64
+	err := cfg.queryTyped(path, func(value string) (err error) {
+		size, err = ParseByteSize(value)
+		return
+	})
+	return size, err
+}
+
+// QueryAddr returns a single value after checking it's a valid network address
+func (cfg Config) QueryAddr(path string) (string, *errors.Error) {
+	var addr string
+	err := cfg.queryTyped(path, func(value string) (err error) {
+		addr, err = ParseAddr(value)
+		return
+	})
+	return addr, err
+}
+
+// QueryList returns all the values of the first property matching a path
+func (cfg Config) QueryList(path string) ([]string, *errors.Error) {
+	results, err := cfg.Query(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) < 1 {
+		return nil, errors.NewError(QueryErrSingleTooFewResults).WithInfo("Path: %s", path)
+	}
+	return results[0].Values, nil
+}
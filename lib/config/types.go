@@ -0,0 +1,94 @@
+package config
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ErrSrcValue errors.ErrorSource = "cfg value"
+
+	ValueErrEmptySize             = errors.NewType(ErrSrcValue, "byte size passed was empty")
+	ValueErrUnknownByteMultiplier = errors.NewType(ErrSrcValue, "unknown byte multiplier")
+	ValueErrInvalid               = errors.NewType(ErrSrcValue, "invalid value")
+)
+
+// ParseByteSize parses a human readable byte size to its byte count
+// ex. 10M -> 10 * 1024 * 1024 -> 10485760
+func ParseByteSize(size string) (uint64, error) {
+	if len(size) < 1 {
+		return 0, errors.NewError(ValueErrEmptySize)
+	}
+
+	lastChar := strings.ToUpper(size)[len(size)-1]
+	if unicode.IsLetter(rune(lastChar)) {
+		num, err := strconv.ParseUint(size[0:len(size)-1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		const units = "KMGTPE"
+		multiplier := strings.IndexByte(units, lastChar)
+		if multiplier < 0 {
+			return 0, errors.NewError(ValueErrUnknownByteMultiplier).WithInfo("Size: %s", size)
+		}
+
+		shift := 10 * uint(multiplier+1)
+		if num > math.MaxUint64>>shift {
+			return 0, errors.NewError(ValueErrInvalid).WithInfo("Size %s is too big", size)
+		}
+		return num << shift, nil
+	}
+
+	return strconv.ParseUint(size, 10, 64)
+}
+
+// ParseBool parses on/off switches (yes/no and true/false are also accepted)
+func ParseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "yes", "true":
+		return true, nil
+	case "off", "no", "false":
+		return false, nil
+	}
+	return false, errors.NewError(ValueErrInvalid).WithInfo("'%s' is not on or off", value)
+}
+
+// ParseDuration parses a non-negative duration like "30s" or "5m"
+func ParseDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, errors.NewError(ValueErrInvalid).WithInfo("'%s' is negative", value)
+	}
+	return duration, nil
+}
+
+// ParseAddr checks a network address, either "host" or "host:port"
+func ParseAddr(value string) (string, error) {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		// No port, but IPv6 literals contain colons too
+		if strings.Contains(value, ":") && net.ParseIP(value) == nil {
+			return "", errors.NewError(ValueErrInvalid).WithInfo("'%s' is not a valid address", value)
+		}
+		host = value
+	} else {
+		num, err := strconv.Atoi(port)
+		if err != nil || num < 1 || num > 65535 {
+			return "", errors.NewError(ValueErrInvalid).WithInfo("'%s' has an invalid port", value)
+		}
+	}
+	if host == "" {
+		return "", errors.NewError(ValueErrInvalid).WithInfo("'%s' is missing the host", value)
+	}
+	return value, nil
+}
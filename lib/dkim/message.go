@@ -0,0 +1,130 @@
+package dkim
+
+import (
+	"strings"
+)
+
+// header is a single (possibly folded) header field, Raw includes the
+// trailing CRLF
+type header struct {
+	Name string
+	Raw  string
+}
+
+// toCRLF normalizes line endings, mail we handle can contain a mix of both
+func toCRLF(message string) string {
+	if !strings.Contains(message, "\n") {
+		return message
+	}
+	message = strings.Replace(message, "\r\n", "\n", -1)
+	return strings.Replace(message, "\n", "\r\n", -1)
+}
+
+// splitMessage splits a CRLF message into its header fields and body
+func splitMessage(message string) ([]header, string) {
+	var headerBlock, body string
+	if strings.HasPrefix(message, "\r\n") {
+		body = message[2:]
+	} else if sep := strings.Index(message, "\r\n\r\n"); sep >= 0 {
+		headerBlock = message[:sep+2]
+		body = message[sep+4:]
+	} else {
+		headerBlock = message
+	}
+
+	var headers []header
+	for _, line := range strings.SplitAfter(headerBlock, "\r\n") {
+		if line == "" {
+			continue
+		}
+		// Continuation lines start with whitespace
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Raw += line
+			continue
+		}
+		name := line
+		if colon := strings.IndexByte(line, ':'); colon >= 0 {
+			name = line[:colon]
+		}
+		headers = append(headers, header{
+			Name: strings.TrimSpace(name),
+			Raw:  line,
+		})
+	}
+
+	return headers, body
+}
+
+// relaxedHeader canonicalizes a header field (RFC 6376 section 3.4.2)
+func relaxedHeader(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	if colon < 0 {
+		return strings.ToLower(strings.TrimSpace(raw)) + ":\r\n"
+	}
+	name := strings.ToLower(strings.TrimSpace(raw[:colon]))
+	value := raw[colon+1:]
+
+	// Unfold and compress whitespace
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = compressWSP(value)
+	value = strings.TrimSpace(value)
+
+	return name + ":" + value + "\r\n"
+}
+
+// relaxedBody canonicalizes a message body (RFC 6376 section 3.4.4)
+func relaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(compressWSP(line), " ")
+	}
+
+	// Remove empty lines at the end of the body
+	end := len(lines)
+	for end > 0 && lines[end-1] == "" {
+		end--
+	}
+	if end == 0 {
+		return ""
+	}
+
+	return strings.Join(lines[:end], "\r\n") + "\r\n"
+}
+
+func compressWSP(str string) string {
+	var out strings.Builder
+	inWSP := false
+	for i := 0; i < len(str); i++ {
+		if str[i] == ' ' || str[i] == '\t' {
+			if !inWSP {
+				out.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		out.WriteByte(str[i])
+	}
+	return out.String()
+}
+
+// selectHeaders picks the header instances to sign or verify for each name
+// in the list, starting from the bottom (RFC 6376 section 5.4.2). Names
+// without an unused instance are skipped.
+func selectHeaders(headers []header, names []string) []string {
+	used := make(map[int]bool)
+	var selected []string
+
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headers[i].Name, name) {
+				continue
+			}
+			used[i] = true
+			selected = append(selected, relaxedHeader(headers[i].Raw))
+			break
+		}
+	}
+
+	return selected
+}
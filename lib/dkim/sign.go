@@ -0,0 +1,171 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ErrSrcDKIM errors.ErrorSource = "dkim"
+
+	DKIMErrInvalidKey     = errors.NewType(ErrSrcDKIM, "invalid private key")
+	DKIMErrUnsupportedKey = errors.NewType(ErrSrcDKIM, "unsupported key type")
+	DKIMErrMissingFrom    = errors.NewType(ErrSrcDKIM, "message has no From header")
+	DKIMErrSigningFailed  = errors.NewType(ErrSrcDKIM, "could not sign message")
+)
+
+// DefaultSignedHeaders are the headers we sign if present
+var DefaultSignedHeaders = []string{
+	"From", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Signer adds DKIM signatures (RFC 6376) using relaxed/relaxed canonicalization
+type Signer struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+	Headers  []string
+}
+
+// NewSigner creates a signer for a domain with the default header list
+func NewSigner(domain, selector string, key crypto.Signer) *Signer {
+	return &Signer{
+		Domain:   domain,
+		Selector: selector,
+		Key:      key,
+		Headers:  DefaultSignedHeaders,
+	}
+}
+
+// LoadKey reads a PEM encoded RSA or Ed25519 private key
+func LoadKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.NewError(DKIMErrInvalidKey).WithInfo("File <%s> is not PEM encoded", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.NewError(DKIMErrInvalidKey).WithError(err).WithInfo("File <%s>", path)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.NewError(DKIMErrInvalidKey).WithError(err).WithInfo("File <%s>", path)
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+	}
+
+	return nil, errors.NewError(DKIMErrUnsupportedKey).WithInfo("File <%s>", path)
+}
+
+// Sign returns the message with a DKIM-Signature header added on top. Line
+// endings are normalized to CRLF, as they will be on the wire.
+func (s *Signer) Sign(message string) (string, error) {
+	message = toCRLF(message)
+	headers, body := splitMessage(message)
+
+	var algorithm string
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algorithm = "ed25519-sha256"
+	default:
+		return "", errors.NewError(DKIMErrUnsupportedKey)
+	}
+
+	// Only sign the headers that are actually there
+	var names []string
+	hasFrom := false
+	for _, name := range s.Headers {
+		for _, h := range headers {
+			if strings.EqualFold(h.Name, name) {
+				names = append(names, name)
+				if strings.EqualFold(name, "From") {
+					hasFrom = true
+				}
+			}
+		}
+	}
+	if !hasFrom {
+		return "", errors.NewError(DKIMErrMissingFrom)
+	}
+
+	bodyHash := sha256.Sum256([]byte(relaxedBody(body)))
+
+	tags := []string{
+		"v=1",
+		"a=" + algorithm,
+		"c=relaxed/relaxed",
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		fmt.Sprintf("t=%d", time.Now().Unix()),
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	sigHeader := "DKIM-Signature: " + strings.Join(tags, ";\r\n\t")
+
+	// Hash the signed headers followed by our own header with an empty b=
+	hash := sha256.New()
+	for _, canonical := range selectHeaders(headers, names) {
+		hash.Write([]byte(canonical))
+	}
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader(sigHeader+"\r\n"), "\r\n")))
+	digest := hash.Sum(nil)
+
+	var signature []byte
+	var err error
+	if algorithm == "ed25519-sha256" {
+		// Ed25519 signs the hash itself (RFC 8463 section 3)
+		signature, err = s.Key.Sign(rand.Reader, digest, crypto.Hash(0))
+	} else {
+		signature, err = s.Key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return "", errors.NewError(DKIMErrSigningFailed).WithError(err)
+	}
+
+	return sigHeader + foldBase64(base64.StdEncoding.EncodeToString(signature)) + "\r\n" + message, nil
+}
+
+// foldBase64 splits a long base64 value on multiple lines
+func foldBase64(value string) string {
+	const lineLength = 72
+	var out strings.Builder
+	for len(value) > lineLength {
+		out.WriteString(value[:lineLength])
+		out.WriteString("\r\n\t")
+		value = value[lineLength:]
+	}
+	out.WriteString(value)
+	return out.String()
+}
@@ -0,0 +1,353 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hamcha/meiru/lib/dns"
+)
+
+// Status is the outcome of a signature verification (RFC 8601 section 2.7.1)
+type Status string
+
+const (
+	StatusNone      Status = "none"
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusNeutral   Status = "neutral"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+// Result is the verification result of a single DKIM-Signature header
+type Result struct {
+	Status    Status
+	Domain    string
+	Selector  string
+	Signature string
+	Reason    string
+}
+
+// String formats the result for an Authentication-Results header
+func (r Result) String() string {
+	if r.Status == StatusNone {
+		return "dkim=none"
+	}
+
+	out := "dkim=" + string(r.Status)
+	if r.Reason != "" {
+		out += " (" + r.Reason + ")"
+	}
+	if r.Domain != "" {
+		out += " header.d=" + r.Domain
+	}
+	if r.Selector != "" {
+		out += " header.s=" + r.Selector
+	}
+	// The first 8 characters are enough to tell signatures apart (RFC 6008)
+	if len(r.Signature) >= 8 {
+		out += " header.b=" + r.Signature[:8]
+	}
+	return out
+}
+
+// Verify checks every DKIM-Signature header of a message, fetching keys
+// through the resolver. A message without signatures has a single "none" result.
+func Verify(ctx context.Context, resolver dns.Resolver, message string) []Result {
+	message = toCRLF(message)
+	headers, body := splitMessage(message)
+
+	var results []Result
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "DKIM-Signature") {
+			results = append(results, verifySignature(ctx, resolver, headers, body, h))
+		}
+	}
+
+	if len(results) < 1 {
+		return []Result{{Status: StatusNone}}
+	}
+	return results
+}
+
+func verifySignature(ctx context.Context, resolver dns.Resolver, headers []header, body string, sigHeader header) Result {
+	colon := strings.IndexByte(sigHeader.Raw, ':')
+	tags, err := parseTags(sigHeader.Raw[colon+1:])
+	if err != nil {
+		return Result{Status: StatusPermError, Reason: "malformed signature"}
+	}
+
+	result := Result{
+		Domain:    tags["d"],
+		Selector:  tags["s"],
+		Signature: tags["b"],
+	}
+	fail := func(status Status, reason string) Result {
+		result.Status = status
+		result.Reason = reason
+		return result
+	}
+
+	// Check required tags
+	if tags["v"] != "1" {
+		return fail(StatusPermError, "unsupported version")
+	}
+	for _, required := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[required] == "" {
+			return fail(StatusPermError, "missing "+required+"= tag")
+		}
+	}
+
+	algorithm := strings.ToLower(tags["a"])
+	if algorithm != "rsa-sha256" && algorithm != "ed25519-sha256" {
+		return fail(StatusPermError, "unsupported algorithm")
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		headerCanon = parts[0]
+		if len(parts) > 1 {
+			bodyCanon = parts[1]
+		}
+	}
+	if !isCanon(headerCanon) || !isCanon(bodyCanon) {
+		return fail(StatusPermError, "unsupported canonicalization")
+	}
+
+	names := strings.Split(tags["h"], ":")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	hasFrom := false
+	for _, name := range names {
+		if strings.EqualFold(name, "From") {
+			hasFrom = true
+		}
+	}
+	if !hasFrom {
+		return fail(StatusPermError, "From header not signed")
+	}
+
+	if expiration, ok := tags["x"]; ok {
+		x, err := strconv.ParseInt(expiration, 10, 64)
+		if err == nil && time.Now().Unix() > x {
+			return fail(StatusPermError, "signature expired")
+		}
+	}
+
+	// Check the body hash
+	canonBody := relaxedBody(body)
+	if bodyCanon == "simple" {
+		canonBody = simpleBody(body)
+	}
+	if length, ok := tags["l"]; ok {
+		l, err := strconv.Atoi(length)
+		if err != nil || l < 0 || l > len(canonBody) {
+			return fail(StatusPermError, "invalid body length")
+		}
+		canonBody = canonBody[:l]
+	}
+	bodyHash := sha256.Sum256([]byte(canonBody))
+	expectedBodyHash, err := base64.StdEncoding.DecodeString(stripWSP(tags["bh"]))
+	if err != nil {
+		return fail(StatusPermError, "malformed body hash")
+	}
+	if string(bodyHash[:]) != string(expectedBodyHash) {
+		return fail(StatusFail, "body hash did not verify")
+	}
+
+	// Hash the signed headers
+	hash := sha256.New()
+	if headerCanon == "relaxed" {
+		for _, canonical := range selectHeaders(headers, names) {
+			hash.Write([]byte(canonical))
+		}
+		hash.Write([]byte(strings.TrimSuffix(relaxedHeader(stripSignature(sigHeader.Raw)), "\r\n")))
+	} else {
+		for _, raw := range selectRawHeaders(headers, names) {
+			hash.Write([]byte(raw))
+		}
+		hash.Write([]byte(stripSignature(strings.TrimSuffix(sigHeader.Raw, "\r\n"))))
+	}
+	digest := hash.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return fail(StatusPermError, "malformed signature data")
+	}
+
+	// Fetch the public key
+	key, status, reason := fetchKey(ctx, resolver, result.Selector, result.Domain)
+	if key == nil {
+		return fail(status, reason)
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "rsa-sha256" {
+			return fail(StatusPermError, "key type does not match algorithm")
+		}
+		if pub.N.BitLen() < 1024 {
+			return fail(StatusPermError, "key too short")
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) != nil {
+			return fail(StatusFail, "signature did not verify")
+		}
+	case ed25519.PublicKey:
+		if algorithm != "ed25519-sha256" {
+			return fail(StatusPermError, "key type does not match algorithm")
+		}
+		if !ed25519.Verify(pub, digest, signature) {
+			return fail(StatusFail, "signature did not verify")
+		}
+	default:
+		return fail(StatusPermError, "unsupported key type")
+	}
+
+	result.Status = StatusPass
+	return result
+}
+
+// fetchKey gets the public key from the selector's TXT record (RFC 6376 section 3.6.2)
+func fetchKey(ctx context.Context, resolver dns.Resolver, selector, domain string) (crypto.PublicKey, Status, string) {
+	records, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, StatusPermError, "no key for signature"
+		}
+		return nil, StatusTempError, "key unavailable"
+	}
+	if len(records) < 1 {
+		return nil, StatusPermError, "no key for signature"
+	}
+
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, StatusPermError, "malformed key record"
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, StatusPermError, "unsupported key version"
+	}
+
+	data := stripWSP(tags["p"])
+	if data == "" {
+		return nil, StatusPermError, "key revoked"
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, StatusPermError, "malformed key"
+	}
+
+	switch strings.ToLower(tags["k"]) {
+	case "", "rsa":
+		// Usually SubjectPublicKeyInfo, but some publish a bare PKCS#1 key
+		if key, err := x509.ParsePKIXPublicKey(raw); err == nil {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok {
+				return rsaKey, StatusPass, ""
+			}
+			return nil, StatusPermError, "key type mismatch"
+		}
+		key, err := x509.ParsePKCS1PublicKey(raw)
+		if err != nil {
+			return nil, StatusPermError, "malformed key"
+		}
+		return key, StatusPass, ""
+	case "ed25519":
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, StatusPermError, "malformed key"
+		}
+		return ed25519.PublicKey(raw), StatusPass, ""
+	}
+
+	return nil, StatusPermError, "unsupported key type"
+}
+
+// parseTags parses a tag=value list (RFC 6376 section 3.2)
+func parseTags(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(list, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("malformed tag: %s", part)
+		}
+		name := strings.TrimSpace(part[:eq])
+		value := strings.TrimSpace(strings.Replace(part[eq+1:], "\r\n", "", -1))
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag: %s", name)
+		}
+		tags[name] = value
+	}
+	return tags, nil
+}
+
+// stripSignature removes the value of the b= tag from a DKIM-Signature header
+func stripSignature(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	parts := strings.Split(raw[colon+1:], ";")
+	for i, part := range parts {
+		eq := strings.IndexByte(part, '=')
+		if eq >= 0 && strings.TrimSpace(part[:eq]) == "b" {
+			parts[i] = part[:eq+1]
+		}
+	}
+	return raw[:colon+1] + strings.Join(parts, ";")
+}
+
+// selectRawHeaders is selectHeaders for the simple canonicalization
+func selectRawHeaders(headers []header, names []string) []string {
+	used := make(map[int]bool)
+	var selected []string
+
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headers[i].Name, name) {
+				continue
+			}
+			used[i] = true
+			selected = append(selected, headers[i].Raw)
+			break
+		}
+	}
+
+	return selected
+}
+
+// simpleBody canonicalizes a message body (RFC 6376 section 3.4.3)
+func simpleBody(body string) string {
+	for strings.HasSuffix(body, "\r\n\r\n") {
+		body = body[:len(body)-2]
+	}
+	if body == "" || body == "\r\n" {
+		return "\r\n"
+	}
+	if !strings.HasSuffix(body, "\r\n") {
+		body += "\r\n"
+	}
+	return body
+}
+
+func isCanon(name string) bool {
+	return name == "simple" || name == "relaxed"
+}
+
+func stripWSP(str string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, str)
+}
@@ -0,0 +1,131 @@
+package dmarc
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+
+	"github.com/hamcha/meiru/lib/dkim"
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/errors"
+	"github.com/hamcha/meiru/lib/spf"
+)
+
+// Status is the DMARC verdict for a message (RFC 8601 section 2.7.5)
+type Status string
+
+const (
+	StatusNone      Status = "none"
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+// Input is what is known about a message when evaluating its DMARC policy
+type Input struct {
+	// Domain of the RFC5322.From header
+	FromDomain string
+
+	// SPF result and the domain it was checked for (MAIL FROM or HELO)
+	SPF       spf.Result
+	SPFDomain string
+
+	DKIM []dkim.Result
+}
+
+// Result is the outcome of a DMARC evaluation
+type Result struct {
+	Status Status
+
+	// What should be done with the message
+	Disposition Policy
+
+	FromDomain   string
+	PolicyDomain string
+	Record       *Record
+
+	SPFAligned  bool
+	DKIMAligned bool
+
+	// Copy of the input, used for reports
+	Input Input
+}
+
+// String formats the result for an Authentication-Results header
+func (r Result) String() string {
+	out := "dmarc=" + string(r.Status)
+	if r.Record != nil {
+		out += " (p=" + string(r.Record.Policy) + " dis=" + string(r.Disposition) + ")"
+	}
+	if r.FromDomain != "" {
+		out += " header.from=" + r.FromDomain
+	}
+	return out
+}
+
+// Evaluate checks the authentication results against the policy of the
+// From domain (RFC 7489 section 6.6)
+func Evaluate(ctx context.Context, resolver dns.Resolver, input Input) Result {
+	result := Result{
+		Status:      StatusNone,
+		Disposition: PolicyNone,
+		FromDomain:  strings.ToLower(input.FromDomain),
+		Input:       input,
+	}
+	if result.FromDomain == "" {
+		return result
+	}
+
+	record, policyDomain, err := Lookup(ctx, resolver, result.FromDomain)
+	result.PolicyDomain = policyDomain
+	if err != nil {
+		if e, ok := err.(*errors.Error); ok && e.Type == DMARCErrLookupFailed {
+			result.Status = StatusTempError
+		} else {
+			result.Status = StatusPermError
+		}
+		return result
+	}
+	if record == nil {
+		return result
+	}
+	result.Record = record
+
+	// Check identifier alignment
+	if input.SPF == spf.Pass && input.SPFDomain != "" {
+		result.SPFAligned = Aligned(input.SPFDomain, result.FromDomain, record.SPFAlignment)
+	}
+	for _, signature := range input.DKIM {
+		if signature.Status == dkim.StatusPass && Aligned(signature.Domain, result.FromDomain, record.DKIMAlignment) {
+			result.DKIMAligned = true
+			break
+		}
+	}
+
+	if result.SPFAligned || result.DKIMAligned {
+		result.Status = StatusPass
+		return result
+	}
+	result.Status = StatusFail
+
+	// Subdomains use their own policy when the record comes from the
+	// organizational domain
+	policy := record.Policy
+	if policyDomain != result.FromDomain {
+		policy = record.SubdomainPolicy
+	}
+
+	// Messages outside the sampled percentage get the next milder policy
+	if record.Percent < 100 && rand.Intn(100) >= record.Percent {
+		switch policy {
+		case PolicyReject:
+			policy = PolicyQuarantine
+		case PolicyQuarantine:
+			policy = PolicyNone
+		}
+	}
+
+	result.Disposition = policy
+	return result
+}
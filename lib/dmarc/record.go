@@ -0,0 +1,223 @@
+package dmarc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ErrSrcDMARC errors.ErrorSource = "dmarc"
+
+	DMARCErrInvalidRecord   = errors.NewType(ErrSrcDMARC, "invalid DMARC record")
+	DMARCErrMultipleRecords = errors.NewType(ErrSrcDMARC, "domain has more than one DMARC record")
+	DMARCErrLookupFailed    = errors.NewType(ErrSrcDMARC, "DNS lookup failed")
+)
+
+// Policy is what the domain owner wants done with failing mail
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// Alignment modes for the adkim and aspf tags
+type Alignment string
+
+const (
+	AlignRelaxed Alignment = "r"
+	AlignStrict  Alignment = "s"
+)
+
+// DefaultReportInterval is the default aggregate report interval in seconds.
+// Reports are always sent daily regardless of the interval a record asks for,
+// which RFC 7489 section 6.3 allows (other intervals are best-effort).
+const DefaultReportInterval = 86400
+
+// Record is a published DMARC policy (RFC 7489 section 6.3)
+type Record struct {
+	Policy          Policy
+	SubdomainPolicy Policy
+	DKIMAlignment   Alignment
+	SPFAlignment    Alignment
+	Percent         int
+	ReportInterval  int
+
+	// Addresses that want aggregate reports (only mailto: URIs are kept)
+	AggregateReports []string
+}
+
+// ParseRecord parses the TXT record published at _dmarc.<domain>
+func ParseRecord(txt string) (*Record, error) {
+	record := &Record{
+		DKIMAlignment:  AlignRelaxed,
+		SPFAlignment:   AlignRelaxed,
+		Percent:        100,
+		ReportInterval: DefaultReportInterval,
+	}
+
+	for i, part := range strings.Split(txt, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			return nil, errors.NewError(DMARCErrInvalidRecord).WithInfo("Malformed tag: %s", part)
+		}
+		name := strings.ToLower(strings.TrimSpace(part[:eq]))
+		value := strings.TrimSpace(part[eq+1:])
+
+		// The version must be the first tag
+		if i == 0 {
+			if name != "v" || value != "DMARC1" {
+				return nil, errors.NewError(DMARCErrInvalidRecord).WithInfo("Record does not start with v=DMARC1")
+			}
+			continue
+		}
+
+		switch name {
+		case "p", "sp":
+			policy, ok := parsePolicy(value)
+			if !ok {
+				return nil, errors.NewError(DMARCErrInvalidRecord).WithInfo("Invalid policy: %s", value)
+			}
+			if name == "p" {
+				record.Policy = policy
+			} else {
+				record.SubdomainPolicy = policy
+			}
+		case "adkim", "aspf":
+			alignment := Alignment(strings.ToLower(value))
+			if alignment != AlignRelaxed && alignment != AlignStrict {
+				return nil, errors.NewError(DMARCErrInvalidRecord).WithInfo("Invalid alignment mode: %s", value)
+			}
+			if name == "adkim" {
+				record.DKIMAlignment = alignment
+			} else {
+				record.SPFAlignment = alignment
+			}
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, errors.NewError(DMARCErrInvalidRecord).WithInfo("Invalid percentage: %s", value)
+			}
+			record.Percent = pct
+		case "ri":
+			ri, err := strconv.Atoi(value)
+			if err == nil && ri > 0 {
+				record.ReportInterval = ri
+			}
+		case "rua":
+			for _, uri := range strings.Split(value, ",") {
+				uri = strings.TrimSpace(uri)
+				if len(uri) < 7 || !strings.EqualFold(uri[:7], "mailto:") {
+					continue
+				}
+				// Drop the size limit suffix (eg. "!10m")
+				address := uri[7:]
+				if bang := strings.IndexByte(address, '!'); bang >= 0 {
+					address = address[:bang]
+				}
+				if address != "" {
+					record.AggregateReports = append(record.AggregateReports, address)
+				}
+			}
+		}
+		// Unknown tags are ignored
+	}
+
+	if record.Policy == "" {
+		// A record without policy but with report addresses counts as p=none
+		if len(record.AggregateReports) < 1 {
+			return nil, errors.NewError(DMARCErrInvalidRecord).WithInfo("Missing p= tag")
+		}
+		record.Policy = PolicyNone
+	}
+	if record.SubdomainPolicy == "" {
+		record.SubdomainPolicy = record.Policy
+	}
+
+	return record, nil
+}
+
+// Lookup finds the DMARC record for a domain, falling back to its
+// organizational domain. The domain the record was found at is returned,
+// a nil record with no error means there is no policy.
+func Lookup(ctx context.Context, resolver dns.Resolver, domain string) (*Record, string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	record, err := lookupRecord(ctx, resolver, domain)
+	if err != nil || record != nil {
+		return record, domain, err
+	}
+
+	org := OrganizationalDomain(domain)
+	if org == domain {
+		return nil, domain, nil
+	}
+	record, err = lookupRecord(ctx, resolver, org)
+	return record, org, err
+}
+
+func lookupRecord(ctx context.Context, resolver dns.Resolver, domain string) (*Record, error) {
+	records, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.NewError(DMARCErrLookupFailed).WithError(err).WithInfo("Domain: %s", domain)
+	}
+
+	var found *Record
+	for _, txt := range records {
+		record, err := ParseRecord(txt)
+		if err != nil {
+			// Records that aren't DMARC are ignored
+			continue
+		}
+		if found != nil {
+			return nil, errors.NewError(DMARCErrMultipleRecords).WithInfo("Domain: %s", domain)
+		}
+		found = record
+	}
+
+	return found, nil
+}
+
+// OrganizationalDomain returns the registered domain of a host name
+// (RFC 7489 section 3.2), or the name itself if it can't be determined
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// Aligned checks if two domains are aligned under the given mode
+func Aligned(a, b string, mode Alignment) bool {
+	a = strings.ToLower(strings.TrimSuffix(a, "."))
+	b = strings.ToLower(strings.TrimSuffix(b, "."))
+	if mode == AlignStrict {
+		return a == b
+	}
+	return OrganizationalDomain(a) == OrganizationalDomain(b)
+}
+
+func parsePolicy(value string) (Policy, bool) {
+	policy := Policy(strings.ToLower(value))
+	switch policy {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return policy, true
+	}
+	return "", false
+}
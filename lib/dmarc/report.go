@@ -0,0 +1,232 @@
+package dmarc
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamcha/meiru/lib/dns"
+)
+
+// Reporter collects DMARC results to send aggregate reports to the domains
+// that asked for them (RFC 7489 section 7.2)
+type Reporter struct {
+	mutex   sync.Mutex
+	begin   time.Time
+	domains map[string]*aggregate
+}
+
+type aggregate struct {
+	record  Record
+	rows    map[string]*feedbackRecord
+	ordered []*feedbackRecord
+}
+
+// Report is an aggregate report for a single policy domain
+type Report struct {
+	ID         string
+	Domain     string
+	Recipients []string
+	Begin      time.Time
+	End        time.Time
+	XML        []byte
+}
+
+type feedback struct {
+	XMLName  xml.Name          `xml:"feedback"`
+	Metadata reportMetadata    `xml:"report_metadata"`
+	Policy   policyPublished   `xml:"policy_published"`
+	Records  []*feedbackRecord `xml:"record"`
+}
+
+type reportMetadata struct {
+	OrgName  string `xml:"org_name"`
+	Email    string `xml:"email"`
+	ReportID string `xml:"report_id"`
+	Begin    int64  `xml:"date_range>begin"`
+	End      int64  `xml:"date_range>end"`
+}
+
+type policyPublished struct {
+	Domain  string `xml:"domain"`
+	ADKIM   string `xml:"adkim"`
+	ASPF    string `xml:"aspf"`
+	Policy  string `xml:"p"`
+	SPolicy string `xml:"sp"`
+	Percent int    `xml:"pct"`
+}
+
+type feedbackRecord struct {
+	SourceIP    string          `xml:"row>source_ip"`
+	Count       int             `xml:"row>count"`
+	Disposition string          `xml:"row>policy_evaluated>disposition"`
+	DKIM        string          `xml:"row>policy_evaluated>dkim"`
+	SPF         string          `xml:"row>policy_evaluated>spf"`
+	HeaderFrom  string          `xml:"identifiers>header_from"`
+	DKIMResults []dkimAuthEntry `xml:"auth_results>dkim"`
+	SPFResult   spfAuthEntry    `xml:"auth_results>spf"`
+}
+
+type dkimAuthEntry struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+type spfAuthEntry struct {
+	Domain string `xml:"domain"`
+	Result string `xml:"result"`
+}
+
+// NewReporter returns a reporter with an empty reporting period
+func NewReporter() *Reporter {
+	return &Reporter{
+		begin:   time.Now(),
+		domains: make(map[string]*aggregate),
+	}
+}
+
+// Add records the result of an evaluation for a message sent from ip
+func (r *Reporter) Add(ip net.IP, result Result) {
+	// Only domains with a policy that wants reports are of interest
+	if result.Record == nil || len(result.Record.AggregateReports) < 1 {
+		return
+	}
+
+	row := &feedbackRecord{
+		SourceIP:    ip.String(),
+		Disposition: string(result.Disposition),
+		DKIM:        passOrFail(result.DKIMAligned),
+		SPF:         passOrFail(result.SPFAligned),
+		HeaderFrom:  result.FromDomain,
+		SPFResult: spfAuthEntry{
+			Domain: result.Input.SPFDomain,
+			Result: string(result.Input.SPF),
+		},
+	}
+	for _, signature := range result.Input.DKIM {
+		if signature.Domain == "" {
+			continue
+		}
+		row.DKIMResults = append(row.DKIMResults, dkimAuthEntry{
+			Domain:   signature.Domain,
+			Selector: signature.Selector,
+			Result:   string(signature.Status),
+		})
+	}
+
+	// Identical rows are merged by counting them
+	key, _ := xml.Marshal(row)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	agg, ok := r.domains[result.PolicyDomain]
+	if !ok {
+		agg = &aggregate{rows: make(map[string]*feedbackRecord)}
+		r.domains[result.PolicyDomain] = agg
+	}
+	agg.record = *result.Record
+
+	if existing, ok := agg.rows[string(key)]; ok {
+		existing.Count++
+		return
+	}
+	row.Count = 1
+	agg.rows[string(key)] = row
+	agg.ordered = append(agg.ordered, row)
+}
+
+// Flush generates the reports for the current period and starts a new one.
+// All domains share the same period, the ri tag of their records is ignored.
+func (r *Reporter) Flush(orgName, email string) []Report {
+	r.mutex.Lock()
+	domains := r.domains
+	begin := r.begin
+	end := time.Now()
+	r.domains = make(map[string]*aggregate)
+	r.begin = end
+	r.mutex.Unlock()
+
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var reports []Report
+	for _, name := range names {
+		agg := domains[name]
+		id := fmt.Sprintf("%s.%d@%s", name, end.Unix(), orgName)
+		doc := feedback{
+			Metadata: reportMetadata{
+				OrgName:  orgName,
+				Email:    email,
+				ReportID: id,
+				Begin:    begin.Unix(),
+				End:      end.Unix(),
+			},
+			Policy: policyPublished{
+				Domain:  name,
+				ADKIM:   string(agg.record.DKIMAlignment),
+				ASPF:    string(agg.record.SPFAlignment),
+				Policy:  string(agg.record.Policy),
+				SPolicy: string(agg.record.SubdomainPolicy),
+				Percent: agg.record.Percent,
+			},
+			Records: agg.ordered,
+		}
+
+		data, err := xml.MarshalIndent(doc, "", "\t")
+		if err != nil {
+			continue
+		}
+
+		reports = append(reports, Report{
+			ID:         id,
+			Domain:     name,
+			Recipients: agg.record.AggregateReports,
+			Begin:      begin,
+			End:        end,
+			XML:        append([]byte(xml.Header), data...),
+		})
+	}
+
+	return reports
+}
+
+// VerifyDestination checks if a report address outside of the policy
+// domain agreed to receive its reports (RFC 7489 section 7.1)
+func VerifyDestination(ctx context.Context, resolver dns.Resolver, policyDomain, address string) bool {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return false
+	}
+	destination := strings.ToLower(address[at+1:])
+	if OrganizationalDomain(destination) == OrganizationalDomain(policyDomain) {
+		return true
+	}
+
+	records, err := resolver.LookupTXT(ctx, policyDomain+"._report._dmarc."+destination)
+	if err != nil {
+		return false
+	}
+	for _, record := range records {
+		if strings.HasPrefix(strings.TrimSpace(record), "v=DMARC1") {
+			return true
+		}
+	}
+	return false
+}
+
+func passOrFail(ok bool) string {
+	if ok {
+		return "pass"
+	}
+	return "fail"
+}
@@ -0,0 +1,263 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	DNSErrQueryFailed     = errors.NewType(ErrSrcDNS, "DNS query failed")
+	DNSErrInvalidResponse = errors.NewType(ErrSrcDNS, "invalid DNS response")
+)
+
+// typeTLSA is not among the types known by dnsmessage
+const typeTLSA dnsmessage.Type = 52
+
+// maxUDPSize is the EDNS0 buffer size we advertise (DNS flag day 2020)
+const maxUDPSize = 1232
+
+// defaultQueryTimeout is used when the context doesn't have a deadline
+const defaultQueryTimeout = 5 * time.Second
+
+// TLSA is a TLSA record (RFC 6698)
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// TLSA certificate usages
+const (
+	TLSAUsagePKIXTA uint8 = 0
+	TLSAUsagePKIXEE uint8 = 1
+	TLSAUsageDANETA uint8 = 2
+	TLSAUsageDANEEE uint8 = 3
+)
+
+// TLSA selectors
+const (
+	TLSASelectorCert uint8 = 0
+	TLSASelectorSPKI uint8 = 1
+)
+
+// TLSA matching types
+const (
+	TLSAMatchFull   uint8 = 0
+	TLSAMatchSHA256 uint8 = 1
+	TLSAMatchSHA512 uint8 = 2
+)
+
+// dnssecQuery sends a query with the AD bit set to a server and returns the
+// parsed response. The AD bit in the response can only be trusted if the path
+// to the (validating) server is trusted, ie. it runs on localhost or was
+// explicitly configured (see NewSystemResolver and NewUpstreamResolver).
+func dnssecQuery(ctx context.Context, server, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(dnsName(name))
+	if err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err).WithInfo("Name: %s", name)
+	}
+
+	// Unpredictable IDs make forged UDP responses harder to get accepted
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err)
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	// Build query with EDNS0 and the DO bit so the server does DNSSEC for us
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+		AuthenticData:    true,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err)
+	}
+	if err := builder.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err)
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err)
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err)
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err)
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultQueryTimeout)
+		defer cancel()
+	}
+
+	// Try UDP first and switch to TCP if the answer doesn't fit
+	resp, err := exchange(ctx, "udp", server, query)
+	if err == nil && resp.Truncated {
+		resp, err = exchange(ctx, "tcp", server, query)
+	}
+	if err != nil {
+		return nil, errors.NewError(DNSErrQueryFailed).WithError(err).WithInfo("Name: %s", name).WithInfo("Server: %s", server)
+	}
+	if resp.ID != id {
+		return nil, errors.NewError(DNSErrInvalidResponse).WithInfo("Mismatched query ID")
+	}
+
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return resp, notFound(name)
+	default:
+		return nil, errors.NewError(DNSErrQueryFailed).WithInfo("Name: %s", name).WithInfo("Response code: %s", resp.RCode)
+	}
+
+	return resp, nil
+}
+
+func exchange(ctx context.Context, network, server string, query []byte) (*dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var buf []byte
+	if network == "tcp" {
+		// TCP messages are prefixed by their length
+		packet := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(packet, uint16(len(query)))
+		copy(packet[2:], query)
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, maxUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		return nil, errors.NewError(DNSErrInvalidResponse).WithError(err)
+	}
+	return &msg, nil
+}
+
+// lookupTLSA queries the TLSA records for a name, returning whether they were
+// DNSSEC authenticated
+func lookupTLSA(ctx context.Context, server, name string) ([]TLSA, bool, error) {
+	resp, err := dnssecQuery(ctx, server, name, typeTLSA)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var records []TLSA
+	for _, answer := range resp.Answers {
+		unknown, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || answer.Header.Type != typeTLSA || len(unknown.Data) < 3 {
+			continue
+		}
+		records = append(records, TLSA{
+			Usage:        unknown.Data[0],
+			Selector:     unknown.Data[1],
+			MatchingType: unknown.Data[2],
+			Data:         append([]byte(nil), unknown.Data[3:]...),
+		})
+	}
+	if len(records) < 1 {
+		return nil, resp.AuthenticData, notFound(name)
+	}
+
+	return records, resp.AuthenticData, nil
+}
+
+// lookupMXAuthenticated queries the MX records for a name, returning whether
+// they were DNSSEC authenticated
+func lookupMXAuthenticated(ctx context.Context, server, name string) ([]*net.MX, bool, error) {
+	resp, err := dnssecQuery(ctx, server, name, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var records []*net.MX
+	for _, answer := range resp.Answers {
+		mx, ok := answer.Body.(*dnsmessage.MXResource)
+		if !ok {
+			continue
+		}
+		records = append(records, &net.MX{
+			Host: mx.MX.String(),
+			Pref: mx.Pref,
+		})
+	}
+	if len(records) < 1 {
+		return nil, resp.AuthenticData, notFound(name)
+	}
+
+	return records, resp.AuthenticData, nil
+}
+
+// systemNameserver returns the first nameserver in /etc/resolv.conf, empty
+// if there is none
+func systemNameserver() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			if addr, err := normalizeUpstream(fields[1]); err == nil {
+				return addr
+			}
+		}
+	}
+	return ""
+}
+
+func dnsName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
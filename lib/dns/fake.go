@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// FakeResolver is an in-memory resolver for offline testing, names are
+// matched case-insensitively and without the trailing dot
+type FakeResolver struct {
+	MX   map[string][]*net.MX
+	IP   map[string][]net.IP
+	TXT  map[string][]string
+	PTR  map[string][]string
+	TLSA map[string][]TLSA
+
+	// Names whose records are reported as DNSSEC authenticated
+	Authenticated map[string]bool
+}
+
+// NewFakeResolver returns an empty in-memory resolver
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{
+		MX:  make(map[string][]*net.MX),
+		IP:  make(map[string][]net.IP),
+		TXT: make(map[string][]string),
+		PTR: make(map[string][]string),
+
+		TLSA:          make(map[string][]TLSA),
+		Authenticated: make(map[string]bool),
+	}
+}
+
+func (f *FakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, ok := f.MX[fakeKey(name)]
+	if !ok {
+		return nil, notFound(name)
+	}
+	// Return a copy, callers are allowed to reorder the results
+	out := make([]*net.MX, len(records))
+	for i, record := range records {
+		mx := *record
+		out[i] = &mx
+	}
+	return out, nil
+}
+
+func (f *FakeResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	records, ok := f.IP[fakeKey(host)]
+	if !ok {
+		return nil, notFound(host)
+	}
+	return append([]net.IP(nil), records...), nil
+}
+
+func (f *FakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := f.TXT[fakeKey(name)]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return append([]string(nil), records...), nil
+}
+
+func (f *FakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	records, ok := f.PTR[fakeKey(addr)]
+	if !ok {
+		return nil, notFound(addr)
+	}
+	return append([]string(nil), records...), nil
+}
+
+func (f *FakeResolver) LookupMXAuthenticated(ctx context.Context, name string) ([]*net.MX, bool, error) {
+	records, err := f.LookupMX(ctx, name)
+	return records, f.Authenticated[fakeKey(name)], err
+}
+
+func (f *FakeResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error) {
+	records, ok := f.TLSA[fakeKey(name)]
+	if !ok {
+		return nil, f.Authenticated[fakeKey(name)], notFound(name)
+	}
+	return append([]TLSA(nil), records...), f.Authenticated[fakeKey(name)], nil
+}
+
+func fakeKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func notFound(name string) error {
+	return &net.DNSError{
+		Err:        "no such host",
+		Name:       name,
+		IsNotFound: true,
+	}
+}
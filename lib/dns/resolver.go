@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ErrSrcDNS errors.ErrorSource = "dns"
+
+	DNSErrInvalidUpstream = errors.NewType(ErrSrcDNS, "invalid upstream resolver address")
+)
+
+// Resolver is the set of DNS lookups used for mail delivery and verification
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+
+	// DNSSEC aware lookups, the returned bool is the AD (authenticated data)
+	// bit of the response. It's always false when the path to the server
+	// can't be trusted to carry it (see NewSystemResolver).
+	LookupMXAuthenticated(ctx context.Context, name string) ([]*net.MX, bool, error)
+	LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error)
+}
+
+type netResolver struct {
+	resolver *net.Resolver
+
+	// Server used for queries the standard library can't do, empty if there
+	// is none whose AD bit can be trusted
+	upstream string
+}
+
+// NewSystemResolver returns a resolver using the operating system's configuration.
+// DNSSEC results are only used if the system nameserver runs on localhost,
+// since anyone on the path to a remote one could forge the AD bit.
+func NewSystemResolver() Resolver {
+	return newSystemResolver(systemNameserver())
+}
+
+func newSystemResolver(upstream string) *netResolver {
+	if host, _, err := net.SplitHostPort(upstream); err != nil || !net.ParseIP(host).IsLoopback() {
+		upstream = ""
+	}
+	return &netResolver{
+		resolver: net.DefaultResolver,
+		upstream: upstream,
+	}
+}
+
+// NewUpstreamResolver returns a resolver that sends all queries to a specific
+// DNS server (ex. "127.0.0.1:53" or "127.0.0.1", port 53 is assumed if missing).
+// The server is trusted to validate DNSSEC, configure a remote one only if
+// the network path to it is secure.
+func NewUpstreamResolver(addr string) (Resolver, error) {
+	upstream, err := normalizeUpstream(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &netResolver{
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, upstream)
+			},
+		},
+		upstream: upstream,
+	}, nil
+}
+
+func (r *netResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.resolver.LookupMX(ctx, name)
+}
+
+func (r *netResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r.resolver.LookupIP(ctx, "ip", host)
+}
+
+func (r *netResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.resolver.LookupTXT(ctx, name)
+}
+
+func (r *netResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.resolver.LookupAddr(ctx, addr)
+}
+
+func (r *netResolver) LookupMXAuthenticated(ctx context.Context, name string) ([]*net.MX, bool, error) {
+	if r.upstream == "" {
+		mx, err := r.LookupMX(ctx, name)
+		return mx, false, err
+	}
+	return lookupMXAuthenticated(ctx, r.upstream, name)
+}
+
+func (r *netResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error) {
+	// Without a trusted server the records could not be used anyway
+	if r.upstream == "" {
+		return nil, false, nil
+	}
+	return lookupTLSA(ctx, r.upstream, name)
+}
+
+func normalizeUpstream(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", errors.NewError(DNSErrInvalidUpstream).WithInfo("Empty address")
+	}
+
+	// Add default port if missing (also handles bare IPv6 addresses)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", errors.NewError(DNSErrInvalidUpstream).WithInfo("Address: %s", addr)
+	}
+
+	return addr, nil
+}
+
+// IsNotFound returns true if the error means that the requested record does not exist
+func IsNotFound(err error) bool {
+	dnserr, ok := err.(*net.DNSError)
+	return ok && dnserr.IsNotFound
+}
@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testTLSA = TLSA{Usage: TLSAUsageDANEEE, Selector: TLSASelectorSPKI, MatchingType: TLSAMatchSHA256, Data: bytes.Repeat([]byte{0xab}, 32)}
+
+// startFakeServer runs a DNS server on localhost that has MX and TLSA records
+// for example.com and claims every answer is DNSSEC authenticated
+func startFakeServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp, err := fakeAnswer(buf[:n]); err == nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func fakeAnswer(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.AuthenticData = true
+	msg.Additionals = nil
+	for _, question := range msg.Questions {
+		header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 300}
+		switch {
+		case question.Name.String() == "example.com." && question.Type == dnsmessage.TypeMX:
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: header,
+				Body:   &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mx.example.com.")},
+			})
+		case question.Name.String() == "_25._tcp.mx.example.com." && question.Type == typeTLSA:
+			data := append([]byte{testTLSA.Usage, testTLSA.Selector, testTLSA.MatchingType}, testTLSA.Data...)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: header,
+				Body:   &dnsmessage.UnknownResource{Type: typeTLSA, Data: data},
+			})
+		default:
+			msg.RCode = dnsmessage.RCodeNameError
+		}
+	}
+
+	return msg.Pack()
+}
+
+func TestNewSystemResolverTrust(t *testing.T) {
+	tests := []struct {
+		nameserver string
+		trusted    bool
+	}{
+		{"127.0.0.1:53", true},
+		{"127.0.0.53:53", true},
+		{"[::1]:53", true},
+		{"192.0.2.53:53", false},
+		{"[2001:db8::53]:53", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		resolver := newSystemResolver(test.nameserver)
+		if trusted := resolver.upstream != ""; trusted != test.trusted {
+			t.Errorf("%q: trusted = %v, want %v", test.nameserver, trusted, test.trusted)
+		}
+	}
+}
+
+func TestUntrustedResolverIgnoresAD(t *testing.T) {
+	server := startFakeServer(t)
+	ctx := context.Background()
+
+	// What NewSystemResolver returns for a nameserver that isn't on localhost,
+	// pointed at the fake server
+	resolver := &netResolver{
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		},
+	}
+
+	mx, authenticated, err := resolver.LookupMXAuthenticated(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("MX lookup failed: %s", err.Error())
+	}
+	if len(mx) != 1 || mx[0].Host != "mx.example.com." {
+		t.Errorf("MX lookup got %v", mx)
+	}
+	if authenticated {
+		t.Errorf("MX records from an untrusted server were reported as authenticated")
+	}
+
+	records, authenticated, err := resolver.LookupTLSA(ctx, "_25._tcp.mx.example.com")
+	if err != nil || records != nil || authenticated {
+		t.Errorf("TLSA lookup on an untrusted server got (%v, %v, %v), want nothing", records, authenticated, err)
+	}
+}
+
+func TestUpstreamResolverTrustsAD(t *testing.T) {
+	server := startFakeServer(t)
+	ctx := context.Background()
+
+	resolver, err := NewUpstreamResolver(server)
+	if err != nil {
+		t.Fatalf("could not create resolver: %s", err.Error())
+	}
+
+	mx, authenticated, err := resolver.LookupMXAuthenticated(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("MX lookup failed: %s", err.Error())
+	}
+	if len(mx) != 1 || mx[0].Host != "mx.example.com." || !authenticated {
+		t.Errorf("MX lookup got (%v, %v), want authenticated mx.example.com.", mx, authenticated)
+	}
+
+	records, authenticated, err := resolver.LookupTLSA(ctx, "_25._tcp.mx.example.com")
+	if err != nil {
+		t.Fatalf("TLSA lookup failed: %s", err.Error())
+	}
+	if !reflect.DeepEqual(records, []TLSA{testTLSA}) || !authenticated {
+		t.Errorf("TLSA lookup got (%v, %v), want authenticated %v", records, authenticated, testTLSA)
+	}
+
+	if _, _, err := resolver.LookupTLSA(ctx, "_25._tcp.nothing.example.com"); !IsNotFound(err) {
+		t.Errorf("TLSA lookup of a missing name got %v, want not found", err)
+	}
+}
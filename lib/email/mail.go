@@ -24,3 +24,46 @@ func Parse(data string) Email {
 		Body:    data[rnIndex:],
 	}
 }
+
+// RemoveHeader removes every occurrence of a header (including folded
+// continuation lines) from the header section of a message
+func RemoveHeader(data string, name string) string {
+	return RemoveHeaderFunc(data, name, func(string) bool { return true })
+}
+
+// RemoveHeaderFunc is RemoveHeader for the occurrences whose value (with
+// continuation lines, after the colon) the remove function returns true for
+func RemoveHeaderFunc(data string, name string, remove func(value string) bool) string {
+	mail := Parse(data)
+	prefix := strings.ToLower(name) + ":"
+
+	var kept []string
+	skipping := false
+	for _, field := range mail.Fields() {
+		skipping = strings.HasPrefix(strings.ToLower(field), prefix) && remove(field[len(prefix):])
+		if !skipping {
+			kept = append(kept, field)
+		}
+	}
+
+	headers := strings.Join(kept, "")
+	// Don't leave a dangling line ending in front of the separator
+	if len(kept) > 0 && skipping {
+		headers = strings.TrimRight(headers, "\r\n")
+	}
+	return headers + mail.Body
+}
+
+// Fields splits the header section into header fields, each one with its
+// continuation lines and line endings
+func (mail Email) Fields() []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(mail.Headers, "\n") {
+		if len(fields) > 0 && len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
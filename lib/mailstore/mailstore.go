@@ -1,18 +1,26 @@
 package mailstore
 
 import (
-	"log"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/hamcha/meiru/lib/config"
+	"github.com/hamcha/meiru/lib/email"
 	"github.com/hamcha/meiru/lib/errors"
 )
 
 var (
 	ErrSrcMailstore errors.ErrorSource = "mailstore"
+
+	ErrMSInvalidConfig = errors.NewType(ErrSrcMailstore, "invalid configuration")
 )
 
+// MailStore holds the local domains and users, indexed by their lowercase
+// names so that lookups don't need to go through the configuration
 type MailStore struct {
-	Domains map[string]Domain
+	domains map[string]Domain
+	lock    sync.RWMutex
 }
 
 type Domain struct {
@@ -22,15 +30,19 @@ type Domain struct {
 
 type User struct {
 	MailboxDir string
+
+	// Password as written in the configuration (scheme and data)
+	Password []string
 }
 
 func NewStore() *MailStore {
 	return &MailStore{}
 }
 
+// LoadConfig (re)builds the domain and user index from the configuration,
+// the previous index is kept if the configuration is not valid
 func (m *MailStore) LoadConfig(cfg *config.Config) error {
-	// Create/Reset domain map
-	m.Domains = make(map[string]Domain)
+	domains := make(map[string]Domain)
 
 	domainProps, err := cfg.Query("domain")
 	if err != nil {
@@ -38,33 +50,93 @@ func (m *MailStore) LoadConfig(cfg *config.Config) error {
 	}
 
 	for _, domain := range domainProps {
-		if len(domain.Values) < 0 {
-			log.Fatalln("Defined domain block without domain name in configuration!")
+		if len(domain.Values) < 1 {
+			return errors.NewError(ErrMSInvalidConfig).WithInfo("%s: Defined domain block without domain name", domain.Position())
 		}
-		domainName := domain.Values[0]
-		catchAll, _ := cfg.QuerySingleSub("catch-all 0", domain.Block)
+		domainName := strings.ToLower(domain.Values[0])
 
-		m.Domains[domainName] = Domain{
-			Users:    make(map[string]User),
-			CatchAll: catchAll,
+		// Blocks for the same domain are merged, the first definition wins
+		dom, ok := domains[domainName]
+		if !ok {
+			dom = Domain{
+				Users: make(map[string]User),
+			}
+		}
+		if dom.CatchAll == "" {
+			catchAll, _ := cfg.QuerySingleSub("catch-all 0", domain.Block)
+			dom.CatchAll = strings.ToLower(catchAll)
 		}
 
 		// Get all users
 		users, err := cfg.QuerySub("user", domain.Block)
 		if err == nil {
 			for _, user := range users {
-				if len(user.Values) < 0 {
-					log.Fatalln("Defined user block without username in configuration!")
+				if len(user.Values) < 1 {
+					return errors.NewError(ErrMSInvalidConfig).WithInfo("%s: Defined user block without username", user.Position())
+				}
+				username := strings.ToLower(user.Values[0])
+				if _, ok := dom.Users[username]; ok {
+					continue
 				}
-				username := user.Values[0]
 				boxDir, _ := cfg.QuerySingleSub("box 0", user.Block)
 				//TODO Fallback to default box if missing on user
-				m.Domains[domainName].Users[username] = User{
+				var password []string
+				if passwords, err := cfg.QuerySub("password", user.Block); err == nil && len(passwords) > 0 {
+					password = passwords[0].Values
+				}
+				dom.Users[username] = User{
 					MailboxDir: boxDir,
+					Password:   password,
 				}
 			}
 		}
+
+		domains[domainName] = dom
 	}
 
+	m.lock.Lock()
+	m.domains = domains
+	m.lock.Unlock()
 	return nil
 }
+
+// IsLocalDomain returns true if mail for the domain is stored locally
+func (m *MailStore) IsLocalDomain(domain string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	_, ok := m.domains[strings.ToLower(domain)]
+	return ok
+}
+
+// DomainNames returns the (lowercase) names of all local domains
+func (m *MailStore) DomainNames() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	names := make([]string, 0, len(m.domains))
+	for name := range m.domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupUser finds a local user by address, catch-all addresses are not
+// considered since they are only meant for delivery
+func (m *MailStore) LookupUser(address string) (User, bool) {
+	name, domain := email.SplitAddress(address)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	dom, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		return User{}, false
+	}
+	user, ok := dom.Users[strings.ToLower(name)]
+	return user, ok
+}
+
+// HasRecipient returns true if mail for an address can be delivered to a
+// local user (directly or through the domain's catch-all)
+func (m *MailStore) HasRecipient(address string) bool {
+	_, err := m.getUser(address)
+	return err == nil
+}
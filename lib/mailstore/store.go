@@ -7,16 +7,25 @@ import (
 	"github.com/hamcha/meiru/lib/errors"
 )
 
+// JunkFolder is where quarantined mail is meant to be delivered
+const JunkFolder = "Junk"
+
 type InboundMailData struct {
 	Recipient  string
 	RealSender string
 	MailData   string
+
+	// Folder to deliver to, empty for the inbox
+	Folder string
 }
 
 var (
 	ErrMSNoValidRecipient = errors.NewType(ErrSrcMailstore, "could not deliver mail to a valid recipient")
 )
 
+// Save delivers mail to a local user.
+// Mail isn't written to any mailbox yet, so Folder has no effect for now:
+// quarantined mail can only be told apart by its X-Quarantine header.
 func (m *MailStore) Save(mail InboundMailData) *errors.Error {
 	_, err := m.getUser(mail.Recipient)
 	if err != nil {
@@ -30,8 +39,11 @@ func (m *MailStore) getUser(address string) (User, *errors.Error) {
 	// Parse recipient
 	name, domain := email.SplitAddress(address)
 
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	// Try get domain
-	dom, ok := m.Domains[strings.ToLower(domain)]
+	dom, ok := m.domains[strings.ToLower(domain)]
 	if !ok {
 		return User{}, errors.NewError(ErrMSNoValidRecipient).WithInfo("Delivery failure reason: domain '%s' is not internal", domain)
 	}
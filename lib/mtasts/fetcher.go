@@ -0,0 +1,168 @@
+package mtasts
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+// maxPolicySize is the largest policy file we are willing to download
+const maxPolicySize = 64 * 1024
+
+// DefaultFetchTimeout is how long fetching a policy can take (RFC 8461 section 3.3)
+const DefaultFetchTimeout = 60 * time.Second
+
+// Fetcher discovers, fetches and caches MTA-STS policies
+type Fetcher struct {
+	mutex sync.Mutex
+	cache map[string]cachedPolicy
+
+	Resolver dns.Resolver
+
+	// HTTPClient is used to download policies, it can be replaced to point
+	// to a local stand-in of the policy host
+	HTTPClient *http.Client
+}
+
+type cachedPolicy struct {
+	policy  *Policy
+	expires time.Time
+}
+
+// NewFetcher creates a policy fetcher using the given resolver for discovery
+func NewFetcher(resolver dns.Resolver) *Fetcher {
+	return &Fetcher{
+		cache:    make(map[string]cachedPolicy),
+		Resolver: resolver,
+		HTTPClient: &http.Client{
+			Timeout: DefaultFetchTimeout,
+			// Redirects must not be followed (RFC 8461 section 3.3)
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Lookup returns the policy for a domain, or nil if the domain doesn't have a
+// (valid) one. Errors are only returned for informational purposes, when a
+// policy can't be found delivery should go on as if the domain had none.
+func (f *Fetcher) Lookup(ctx context.Context, domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	cached, hasCached := f.getCached(domain)
+
+	// Discover the current policy id
+	id, err := f.lookupID(ctx, domain)
+	if err != nil {
+		// Keep using what we have if DNS is not cooperating
+		if hasCached {
+			return cached, nil
+		}
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Skip fetching if the policy hasn't changed
+	if hasCached && cached.ID == id {
+		return cached, nil
+	}
+
+	policy, err := f.fetch(ctx, domain)
+	if err != nil {
+		if hasCached {
+			return cached, err
+		}
+		return nil, err
+	}
+	policy.ID = id
+
+	f.mutex.Lock()
+	f.cache[domain] = cachedPolicy{
+		policy:  policy,
+		expires: time.Now().Add(policy.MaxAge),
+	}
+	f.mutex.Unlock()
+
+	return policy, nil
+}
+
+func (f *Fetcher) getCached(domain string) (*Policy, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	cached, ok := f.cache[domain]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(cached.expires) {
+		delete(f.cache, domain)
+		return nil, false
+	}
+	return cached.policy, true
+}
+
+func (f *Fetcher) lookupID(ctx context.Context, domain string) (string, error) {
+	records, err := f.Resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+
+	// There must be exactly one STSv1 record
+	var ids []string
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		id, err := parseRecord(record)
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) != 1 {
+		return "", errors.NewError(STSErrInvalidRecord).WithInfo("Found %d STSv1 records for %s", len(ids), domain)
+	}
+
+	return ids[0], nil
+}
+
+func (f *Fetcher) fetch(ctx context.Context, domain string) (*Policy, error) {
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.NewError(STSErrFetchFailed).WithError(err)
+	}
+
+	resp, err := f.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.NewError(STSErrFetchFailed).WithError(err).WithInfo("URL: %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.NewError(STSErrFetchFailed).WithInfo("URL: %s", url).WithInfo("HTTP status: %s", resp.Status)
+	}
+	mediatype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediatype != "text/plain" {
+		return nil, errors.NewError(STSErrFetchFailed).WithInfo("URL: %s", url).WithInfo("Unexpected content type: %s", mediatype)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicySize+1))
+	if err != nil {
+		return nil, errors.NewError(STSErrFetchFailed).WithError(err).WithInfo("URL: %s", url)
+	}
+	if len(body) > maxPolicySize {
+		return nil, errors.NewError(STSErrFetchFailed).WithInfo("URL: %s", url).WithInfo("Policy is too large")
+	}
+
+	return ParsePolicy(string(body))
+}
@@ -0,0 +1,176 @@
+package mtasts
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hamcha/meiru/lib/dns"
+)
+
+const testPolicy = "version: STSv1\r\nmode: enforce\r\nmx: mx.example.com\r\nmx: *.backup.example.com\r\nmax_age: 86400\r\n"
+
+// policyHost is a local stand-in for mta-sts.example.com, the httptest
+// certificate is valid for *.example.com
+type policyHost struct {
+	server   *httptest.Server
+	requests int
+
+	status      int
+	contentType string
+	body        string
+	redirect    string
+}
+
+func newPolicyHost(t *testing.T) *policyHost {
+	host := &policyHost{status: http.StatusOK, contentType: "text/plain; charset=utf-8", body: testPolicy}
+	host.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.requests++
+		if r.URL.Path != "/.well-known/mta-sts.txt" || r.Host != "mta-sts.example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		if host.redirect != "" {
+			http.Redirect(w, r, host.redirect, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", host.contentType)
+		w.WriteHeader(host.status)
+		w.Write([]byte(host.body))
+	}))
+	t.Cleanup(host.server.Close)
+	return host
+}
+
+// fetcher returns a Fetcher whose HTTP client connects to the local policy host
+func (host *policyHost) fetcher(resolver dns.Resolver) *Fetcher {
+	fetcher := NewFetcher(resolver)
+	transport := host.server.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, host.server.Listener.Addr().String())
+	}
+	fetcher.HTTPClient.Transport = transport
+	return fetcher
+}
+
+func TestFetcherLookup(t *testing.T) {
+	tests := []struct {
+		name        string
+		txt         []string
+		status      int
+		contentType string
+		body        string
+		redirect    string
+		want        *Policy
+		wantErr     bool
+	}{
+		{
+			name: "valid policy",
+			txt:  []string{"v=STSv1; id=20260101"},
+			want: &Policy{ID: "20260101", Mode: ModeEnforce, MX: []string{"mx.example.com", "*.backup.example.com"}, MaxAge: 24 * time.Hour},
+		},
+		{
+			name: "other TXT records are ignored",
+			txt:  []string{"v=spf1 -all", "v=STSv1; id=abc"},
+			want: &Policy{ID: "abc", Mode: ModeEnforce, MX: []string{"mx.example.com", "*.backup.example.com"}, MaxAge: 24 * time.Hour},
+		},
+		{name: "no record", txt: nil},
+		{name: "multiple records", txt: []string{"v=STSv1; id=1", "v=STSv1; id=2"}, wantErr: true},
+		{name: "record without id", txt: []string{"v=STSv1;"}, wantErr: true},
+		{name: "policy not found", txt: []string{"v=STSv1; id=1"}, status: http.StatusNotFound, wantErr: true},
+		{name: "wrong content type", txt: []string{"v=STSv1; id=1"}, contentType: "text/html", wantErr: true},
+		{name: "redirects are not followed", txt: []string{"v=STSv1; id=1"}, redirect: "https://mta-sts.example.com/other.txt", wantErr: true},
+		{name: "invalid policy", txt: []string{"v=STSv1; id=1"}, body: "version: STSv1\r\nmode: enforce\r\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		host := newPolicyHost(t)
+		if test.status != 0 {
+			host.status = test.status
+		}
+		if test.contentType != "" {
+			host.contentType = test.contentType
+		}
+		if test.body != "" {
+			host.body = test.body
+		}
+		host.redirect = test.redirect
+
+		resolver := dns.NewFakeResolver()
+		if test.txt != nil {
+			resolver.TXT["_mta-sts.example.com"] = test.txt
+		}
+
+		policy, err := host.fetcher(resolver).Lookup(context.Background(), "Example.com.")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got policy %+v", test.name, policy)
+			}
+			if policy != nil {
+				t.Errorf("%s: expected no policy, got %+v", test.name, policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(policy, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, policy, test.want)
+		}
+	}
+}
+
+func TestFetcherCache(t *testing.T) {
+	host := newPolicyHost(t)
+	resolver := dns.NewFakeResolver()
+	resolver.TXT["_mta-sts.example.com"] = []string{"v=STSv1; id=1"}
+	fetcher := host.fetcher(resolver)
+	ctx := context.Background()
+
+	if _, err := fetcher.Lookup(ctx, "example.com"); err != nil {
+		t.Fatalf("first lookup failed: %s", err.Error())
+	}
+
+	// Same id, the policy must not be fetched again
+	if policy, err := fetcher.Lookup(ctx, "example.com"); err != nil || policy == nil {
+		t.Fatalf("cached lookup failed: %v", err)
+	}
+	if host.requests != 1 {
+		t.Errorf("policy fetched %d times with an unchanged id, want 1", host.requests)
+	}
+
+	// The id changed but the new policy can't be fetched, keep the old one
+	resolver.TXT["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	host.status = http.StatusInternalServerError
+	policy, err := fetcher.Lookup(ctx, "example.com")
+	if err == nil {
+		t.Errorf("expected error for a failed refresh")
+	}
+	if policy == nil || policy.ID != "1" {
+		t.Errorf("failed refresh should keep the cached policy, got %+v", policy)
+	}
+
+	// DNS is gone, keep the old one
+	delete(resolver.TXT, "_mta-sts.example.com")
+	if policy, _ := fetcher.Lookup(ctx, "example.com"); policy == nil || policy.ID != "1" {
+		t.Errorf("missing record should keep the cached policy, got %+v", policy)
+	}
+
+	// The id changed and the new policy is available
+	resolver.TXT["_mta-sts.example.com"] = []string{"v=STSv1; id=3"}
+	host.status = http.StatusOK
+	host.body = "version: STSv1\r\nmode: testing\r\nmx: mx.example.com\r\nmax_age: 600\r\n"
+	policy, err = fetcher.Lookup(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("refresh failed: %s", err.Error())
+	}
+	if policy.ID != "3" || policy.Mode != ModeTesting {
+		t.Errorf("refresh got %+v, want id 3 in testing mode", policy)
+	}
+}
@@ -0,0 +1,127 @@
+package mtasts
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ErrSrcMTASTS errors.ErrorSource = "mta-sts"
+
+	STSErrInvalidPolicy = errors.NewType(ErrSrcMTASTS, "invalid policy")
+	STSErrInvalidRecord = errors.NewType(ErrSrcMTASTS, "invalid TXT record")
+	STSErrFetchFailed   = errors.NewType(ErrSrcMTASTS, "could not fetch policy")
+)
+
+// Mode is what a sender should do when a delivery doesn't satisfy the policy
+type Mode string
+
+const (
+	ModeEnforce Mode = "enforce"
+	ModeTesting Mode = "testing"
+	ModeNone    Mode = "none"
+)
+
+// MaxMaxAge is the longest a policy can be cached for (RFC 8461 section 3.2)
+const MaxMaxAge = 31557600 * time.Second
+
+// Policy is a MTA-STS policy as served by the policy host (RFC 8461 section 3.2)
+type Policy struct {
+	ID     string
+	Mode   Mode
+	MX     []string
+	MaxAge time.Duration
+}
+
+// ParsePolicy parses the body of a mta-sts.txt policy file
+func ParsePolicy(body string) (*Policy, error) {
+	policy := &Policy{}
+	version := ""
+	hasMaxAge := false
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		sep := strings.IndexByte(line, ':')
+		if sep < 0 {
+			return nil, errors.NewError(STSErrInvalidPolicy).WithInfo("Malformed line: %s", line)
+		}
+		key := strings.TrimSpace(line[:sep])
+		value := strings.TrimSpace(line[sep+1:])
+
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = Mode(value)
+		case "mx":
+			policy.MX = append(policy.MX, strings.ToLower(strings.TrimSuffix(value, ".")))
+		case "max_age":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, errors.NewError(STSErrInvalidPolicy).WithError(err).WithInfo("Invalid max_age: %s", value)
+			}
+			policy.MaxAge = time.Duration(seconds) * time.Second
+			if policy.MaxAge > MaxMaxAge {
+				policy.MaxAge = MaxMaxAge
+			}
+			hasMaxAge = true
+		}
+		// Unknown keys are ignored to allow for future extensions
+	}
+
+	if version != "STSv1" {
+		return nil, errors.NewError(STSErrInvalidPolicy).WithInfo("Unsupported version: %s", version)
+	}
+	if policy.Mode != ModeEnforce && policy.Mode != ModeTesting && policy.Mode != ModeNone {
+		return nil, errors.NewError(STSErrInvalidPolicy).WithInfo("Unknown mode: %s", policy.Mode)
+	}
+	if !hasMaxAge {
+		return nil, errors.NewError(STSErrInvalidPolicy).WithInfo("Missing max_age")
+	}
+	if policy.Mode != ModeNone && len(policy.MX) < 1 {
+		return nil, errors.NewError(STSErrInvalidPolicy).WithInfo("No mx patterns")
+	}
+
+	return policy, nil
+}
+
+// MatchMX returns true if a MX host name is allowed by the policy, patterns
+// starting with "*." match exactly one extra label (RFC 8461 section 4.1)
+func (p *Policy) MatchMX(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			dot := strings.IndexByte(host, '.')
+			if dot > 0 && host[dot+1:] == pattern[2:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRecord parses a _mta-sts TXT record and returns the policy id
+func parseRecord(record string) (string, error) {
+	fields := strings.Split(record, ";")
+	if strings.TrimSpace(fields[0]) != "v=STSv1" {
+		return "", errors.NewError(STSErrInvalidRecord).WithInfo("Record: %s", record)
+	}
+
+	for _, field := range fields[1:] {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "id=") && len(field) > 3 {
+			return field[3:], nil
+		}
+	}
+
+	return "", errors.NewError(STSErrInvalidRecord).WithInfo("Missing id: %s", record)
+}
@@ -0,0 +1,129 @@
+package smtp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ClientErrAuthUnsupported = errors.NewType(ErrSrcClient, "authentication mechanism not supported")
+	ClientErrAuthFailed      = errors.NewType(ErrSrcClient, "authentication failed")
+)
+
+// AuthMechanisms returns the SASL mechanisms advertised by the server
+func (c *Client) AuthMechanisms() []string {
+	for _, ext := range c.ServerExt {
+		if strings.EqualFold(ext.Name, "AUTH") {
+			return ext.Params
+		}
+	}
+	return nil
+}
+
+// Auth authenticates with the server (RFC 4954) using PLAIN, LOGIN or
+// CRAM-MD5. If no mechanism is specified, the best one supported by the
+// server is used.
+func (c *Client) Auth(ctx context.Context, mechanism, user, pass string) error {
+	mechanism = strings.ToUpper(mechanism)
+	if mechanism == "" {
+		mechanism = c.pickAuthMechanism()
+		if mechanism == "" {
+			return errors.NewError(ClientErrAuthUnsupported).WithInfo("Server mechanisms: %s", strings.Join(c.AuthMechanisms(), " "))
+		}
+	}
+
+	switch mechanism {
+	case "PLAIN":
+		resp := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + pass))
+		reply, err := c.command(ctx, c.Timeouts.Command, "AUTH PLAIN %s", resp)
+		return c.authResult(ctx, reply, err)
+
+	case "LOGIN":
+		if _, err := c.authChallenge(c.command(ctx, c.Timeouts.Command, "AUTH LOGIN")); err != nil {
+			return err
+		}
+		userb64 := base64.StdEncoding.EncodeToString([]byte(user))
+		if _, err := c.authChallenge(c.command(ctx, c.Timeouts.Command, "%s", userb64)); err != nil {
+			return err
+		}
+		passb64 := base64.StdEncoding.EncodeToString([]byte(pass))
+		reply, err := c.command(ctx, c.Timeouts.Command, "%s", passb64)
+		return c.authResult(ctx, reply, err)
+
+	case "CRAM-MD5":
+		challenge, err := c.authChallenge(c.command(ctx, c.Timeouts.Command, "AUTH CRAM-MD5"))
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(md5.New, []byte(pass))
+		mac.Write(challenge)
+		resp := user + " " + hex.EncodeToString(mac.Sum(nil))
+		reply, err := c.command(ctx, c.Timeouts.Command, "%s", base64.StdEncoding.EncodeToString([]byte(resp)))
+		return c.authResult(ctx, reply, err)
+	}
+
+	return errors.NewError(ClientErrAuthUnsupported).WithInfo("Mechanism: %s", mechanism)
+}
+
+func (c *Client) pickAuthMechanism() string {
+	supported := make(map[string]bool)
+	for _, mechanism := range c.AuthMechanisms() {
+		supported[strings.ToUpper(mechanism)] = true
+	}
+
+	// Don't send passwords in the clear if we can avoid it
+	preferred := []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+	if c.tlsState == nil {
+		preferred = []string{"CRAM-MD5", "PLAIN", "LOGIN"}
+	}
+	for _, mechanism := range preferred {
+		if supported[mechanism] {
+			return mechanism
+		}
+	}
+	return ""
+}
+
+// authChallenge checks for a 334 continuation and returns the decoded challenge
+func (c *Client) authChallenge(resp []clientServerReply, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	if resp[0].Code != 334 {
+		return nil, authError(resp)
+	}
+
+	challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(resp[0].Text))
+	if err != nil {
+		return nil, errors.NewError(ClientErrInvalidServerResponse).WithError(err)
+	}
+	return challenge, nil
+}
+
+func (c *Client) authResult(ctx context.Context, resp []clientServerReply, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp[0].Code != 235 {
+		// Abort the exchange if the server is still expecting something
+		if resp[0].Code == 334 {
+			c.command(ctx, c.Timeouts.Command, "*")
+		}
+		return authError(resp)
+	}
+	return nil
+}
+
+func authError(replies []clientServerReply) error {
+	err := errors.NewError(ClientErrAuthFailed)
+	for i, line := range replies {
+		err = err.WithInfo("RECV line %d: %d %s", i, line.Code, line.Text)
+	}
+	return err
+}
@@ -2,10 +2,14 @@ package smtp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hamcha/meiru/lib/errors"
 )
@@ -13,7 +17,41 @@ import (
 type Client struct {
 	conn      net.Conn
 	reader    *bufio.Reader
+	tlsState  *tls.ConnectionState
+	banner    bool
 	ServerExt []ClientServerExt
+
+	// Host name of the server we connected to (without port)
+	ServerName string
+
+	Timeouts ClientTimeouts
+}
+
+// ClientTimeouts is how long to wait for the server at each step of a
+// transaction, see RFC 5321 section 4.5.3.2
+type ClientTimeouts struct {
+	Connect   time.Duration `config:"connect"`
+	Greeting  time.Duration `config:"greeting"`
+	Command   time.Duration `config:"command"`
+	Mail      time.Duration `config:"mail"`
+	Rcpt      time.Duration `config:"rcpt"`
+	DataInit  time.Duration `config:"data_init"`
+	DataBlock time.Duration `config:"data_block"`
+	DataEnd   time.Duration `config:"data_end"`
+	Quit      time.Duration `config:"quit"`
+}
+
+// DefaultClientTimeouts are the timeouts suggested by RFC 5321
+var DefaultClientTimeouts = ClientTimeouts{
+	Connect:   time.Minute,
+	Greeting:  5 * time.Minute,
+	Command:   5 * time.Minute,
+	Mail:      5 * time.Minute,
+	Rcpt:      5 * time.Minute,
+	DataInit:  2 * time.Minute,
+	DataBlock: 3 * time.Minute,
+	DataEnd:   10 * time.Minute,
+	Quit:      30 * time.Second,
 }
 
 type clientServerReply struct {
@@ -31,56 +69,100 @@ var (
 
 	ClientErrInvalidServerResponse = errors.NewType(ErrSrcClient, "invalid response from server")
 	ClientErrReceivedServerError   = errors.NewType(ErrSrcClient, "received error from server")
+	ClientErrRejectedByServer      = errors.NewType(ErrSrcClient, "server permanently rejected the command")
 	ClientErrNoServerResponse      = errors.NewType(ErrSrcClient, "no response from server")
+	ClientErrTLSNotSupported       = errors.NewType(ErrSrcClient, "server does not support STARTTLS")
+	ClientErrTLSAlreadyActive      = errors.NewType(ErrSrcClient, "connection is already encrypted")
+	ClientErrTLSHandshakeFailed    = errors.NewType(ErrSrcClient, "TLS handshake failed")
+	ClientErrMessageTooLarge       = errors.NewType(ErrSrcClient, "message exceeds the server size limit")
+	ClientErrNoValidRecipients     = errors.NewType(ErrSrcClient, "no recipients were accepted by the server")
+	ClientErrTimeout               = errors.NewType(ErrSrcClient, "timed out waiting for server")
+	ClientErrCancelled             = errors.NewType(ErrSrcClient, "operation cancelled")
 )
 
-func NewClient(host string) (*Client, error) {
+// aLongTimeAgo is used as deadline to interrupt pending reads and writes
+var aLongTimeAgo = time.Unix(1, 0)
+
+// NewClient connects to a SMTP server using the default timeouts
+func NewClient(ctx context.Context, host string) (*Client, error) {
+	return NewClientWithTimeouts(ctx, host, DefaultClientTimeouts)
+}
+
+// NewClientWithTimeouts connects to a SMTP server
+func NewClientWithTimeouts(ctx context.Context, host string, timeouts ClientTimeouts) (*Client, error) {
 	if strings.IndexRune(host, ':') < 0 {
 		host += ":25"
 	}
-	sock, err := net.Dial("tcp", host)
+	dialer := net.Dialer{Timeout: timeouts.Connect}
+	sock, err := dialer.DialContext(ctx, "tcp", host)
 	if err != nil {
 		return nil, err
 	}
 
-	reader := bufio.NewReader(sock)
+	return newClient(sock, host, timeouts), nil
+}
 
-	client := Client{
-		conn:   sock,
-		reader: reader,
+// NewClientTLS connects to a server that expects TLS from the start (ie. port 465)
+func NewClientTLS(ctx context.Context, host string, config *tls.Config, timeouts ClientTimeouts) (*Client, error) {
+	if strings.IndexRune(host, ':') < 0 {
+		host += ":465"
+	}
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeouts.Connect},
+		Config:    config,
+	}
+	sock, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
 	}
 
-	return &client, err
+	client := newClient(sock, host, timeouts)
+	state := sock.(*tls.Conn).ConnectionState()
+	client.tlsState = &state
+	return client, nil
 }
 
-func (c *Client) Close() {
-	c.cmd("QUIT")
-	c.getReplies()
-	c.conn.Close()
-}
+func newClient(sock net.Conn, host string, timeouts ClientTimeouts) *Client {
+	serverName, _, _ := net.SplitHostPort(host)
 
-func (c *Client) Greet(host string) error {
-	c.cmd("EHLO %s", host)
+	return &Client{
+		conn:   sock,
+		reader: bufio.NewReader(sock),
 
-	resp, err := c.getReplies()
-	if err != nil {
-		return err
+		ServerName: serverName,
+		Timeouts:   timeouts,
 	}
+}
 
-	// Check if it's the greeting
-	if resp[0].Code == 220 {
-		// Ignore and get next response
-		resp, err = c.getReplies()
+// Close says goodbye to the server and closes the connection
+func (c *Client) Close(ctx context.Context) {
+	c.command(ctx, c.Timeouts.Quit, "QUIT")
+	c.conn.Close()
+}
+
+func (c *Client) Greet(ctx context.Context, host string) error {
+	// Wait for the server to welcome us before saying anything
+	if !c.banner {
+		resp, err := c.readReplies(ctx, c.Timeouts.Greeting)
 		if err != nil {
 			return err
 		}
+		if resp[0].Code != 220 {
+			return replyError(resp)
+		}
+		c.banner = true
+	}
+
+	c.ServerExt = nil
+	resp, err := c.command(ctx, c.Timeouts.Command, "EHLO %s", host)
+	if err != nil {
+		return err
 	}
 
 	// Check if the greet was not successful
 	if resp[0].Code != 250 {
 		// Fall back to HELO
-		c.cmd("HELO %s", host)
-		resp, err = c.getReplies()
+		resp, err = c.command(ctx, c.Timeouts.Command, "HELO %s", host)
 		if err != nil {
 			return err
 		}
@@ -105,9 +187,71 @@ func (c *Client) Greet(host string) error {
 	return nil
 }
 
-func (c *Client) SetSender(addr string) error {
-	c.cmd("MAIL FROM: <%s>", addr)
-	resp, err := c.getReplies()
+// HasExtension returns true if the server advertised an extension in its EHLO reply
+func (c *Client) HasExtension(name string) bool {
+	for _, ext := range c.ServerExt {
+		if strings.EqualFold(ext.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartTLS upgrades the connection to TLS (RFC 3207), the server forgets
+// everything about the session so Greet must be called again afterwards
+func (c *Client) StartTLS(ctx context.Context, config *tls.Config) error {
+	if c.tlsState != nil {
+		return errors.NewError(ClientErrTLSAlreadyActive)
+	}
+	if !c.HasExtension("STARTTLS") {
+		return errors.NewError(ClientErrTLSNotSupported)
+	}
+
+	resp, err := c.command(ctx, c.Timeouts.Command, "STARTTLS")
+	if err != nil {
+		return err
+	}
+	if resp[0].Code != 220 {
+		return replyError(resp)
+	}
+
+	tlsconn := tls.Client(c.conn, config)
+	err = c.withDeadline(ctx, c.Timeouts.Command, func() error {
+		return tlsconn.Handshake()
+	})
+	if err != nil {
+		return errors.NewError(ClientErrTLSHandshakeFailed).WithError(err)
+	}
+
+	state := tlsconn.ConnectionState()
+	c.conn = tlsconn
+	c.reader = bufio.NewReader(tlsconn)
+	c.tlsState = &state
+	c.ServerExt = nil
+	return nil
+}
+
+// TLSState returns the state of the TLS connection, or nil if the connection is not encrypted
+func (c *Client) TLSState() *tls.ConnectionState {
+	return c.tlsState
+}
+
+// MaxSize returns the maximum message size accepted by the server, or 0 if
+// the server didn't declare one
+func (c *Client) MaxSize() uint64 {
+	for _, ext := range c.ServerExt {
+		if strings.EqualFold(ext.Name, "SIZE") && len(ext.Params) > 0 {
+			size, err := strconv.ParseUint(ext.Params[0], 10, 64)
+			if err == nil {
+				return size
+			}
+		}
+	}
+	return 0
+}
+
+func (c *Client) SetSender(ctx context.Context, addr string) error {
+	resp, err := c.command(ctx, c.Timeouts.Mail, "MAIL FROM:<%s>", addr)
 	if err != nil {
 		return err
 	}
@@ -115,9 +259,8 @@ func (c *Client) SetSender(addr string) error {
 	return getResponseError(resp)
 }
 
-func (c *Client) AddRecipient(addr string) error {
-	c.cmd("RCPT TO: <%s>", addr)
-	resp, err := c.getReplies()
+func (c *Client) AddRecipient(ctx context.Context, addr string) error {
+	resp, err := c.command(ctx, c.Timeouts.Rcpt, "RCPT TO:<%s>", addr)
 	if err != nil {
 		return err
 	}
@@ -125,23 +268,153 @@ func (c *Client) AddRecipient(addr string) error {
 	return getResponseError(resp)
 }
 
-func (c *Client) SendData(data string) error {
-	c.cmd("DATA")
-	resp, err := c.getReplies()
+// Reset aborts the current mail transaction, leaving the connection ready for a new one
+func (c *Client) Reset(ctx context.Context) error {
+	resp, err := c.command(ctx, c.Timeouts.Command, "RSET")
 	if err != nil {
 		return err
 	}
 
-	if resp[0].Code != 354 {
-		err := errors.NewError(ClientErrReceivedServerError)
-		for i, line := range resp {
-			err = err.WithInfo("RECV line %d: %d %s", i, line.Code, line.Text)
+	return getResponseError(resp)
+}
+
+// SendData sends the message content, dot-stuffing it and normalizing line endings
+func (c *Client) SendData(ctx context.Context, data io.Reader) error {
+	resp, err := c.command(ctx, c.Timeouts.DataInit, "DATA")
+	if err != nil {
+		return err
+	}
+	if err = getDataResponseError(resp); err != nil {
+		return err
+	}
+
+	return c.writeData(ctx, data)
+}
+
+// Send runs a whole mail transaction. Commands are pipelined if the server
+// supports it (RFC 2920). Recipients refused by the server are returned with
+// the reason they were refused, the message is sent to the others.
+// If every recipient is refused, they are returned along with ClientErrNoValidRecipients.
+// Calling it without recipients returns ClientErrNoValidRecipients.
+// If size is not 0 it's checked against the maximum size declared by the server.
+func (c *Client) Send(ctx context.Context, sender string, recipients []string, data io.Reader, size uint64) (map[string]error, error) {
+	// A transaction needs at least one recipient, don't even start it
+	if len(recipients) < 1 {
+		return nil, errors.NewError(ClientErrNoValidRecipients).WithInfo("No recipients given")
+	}
+
+	// Don't bother sending what the server is going to refuse
+	mailParams := ""
+	if size > 0 && c.HasExtension("SIZE") {
+		if maxsize := c.MaxSize(); maxsize > 0 && size > maxsize {
+			return nil, errors.NewError(ClientErrMessageTooLarge).WithInfo("Message size: %d, server limit: %d", size, maxsize)
+		}
+		mailParams = fmt.Sprintf(" SIZE=%d", size)
+	}
+
+	pipelining := c.HasExtension("PIPELINING")
+	if pipelining {
+		// Send everything in one go and read the replies in order afterwards
+		err := c.withDeadline(ctx, c.Timeouts.Mail, func() error {
+			writer := bufio.NewWriter(c.conn)
+			fmt.Fprintf(writer, "MAIL FROM:<%s>%s\r\n", sender, mailParams)
+			for _, recipient := range recipients {
+				fmt.Fprintf(writer, "RCPT TO:<%s>\r\n", recipient)
+			}
+			fmt.Fprintf(writer, "DATA\r\n")
+			return writer.Flush()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// MAIL FROM
+	var resp []clientServerReply
+	var err error
+	if pipelining {
+		resp, err = c.readReplies(ctx, c.Timeouts.Mail)
+	} else {
+		resp, err = c.command(ctx, c.Timeouts.Mail, "MAIL FROM:<%s>%s", sender, mailParams)
+	}
+	if err != nil {
+		return nil, err
+	}
+	senderErr := getResponseError(resp)
+	if senderErr != nil && !pipelining {
+		return nil, senderErr
+	}
+
+	// RCPT TO
+	rejected := make(map[string]error)
+	for _, recipient := range recipients {
+		if pipelining {
+			resp, err = c.readReplies(ctx, c.Timeouts.Rcpt)
+		} else {
+			resp, err = c.command(ctx, c.Timeouts.Rcpt, "RCPT TO:<%s>", recipient)
 		}
+		if err != nil {
+			return nil, err
+		}
+		if err = getResponseError(resp); err != nil {
+			rejected[recipient] = err
+		}
+	}
+
+	// DATA
+	if pipelining {
+		resp, err = c.readReplies(ctx, c.Timeouts.DataInit)
+	} else {
+		if len(rejected) == len(recipients) {
+			return rejected, errors.NewError(ClientErrNoValidRecipients).WithError(rejected[recipients[0]])
+		}
+		resp, err = c.command(ctx, c.Timeouts.DataInit, "DATA")
+	}
+	if err != nil {
+		return nil, err
+	}
+	dataErr := getDataResponseError(resp)
+
+	// With pipelining the server gets to reply to everything before we can bail out
+	if senderErr != nil {
+		if dataErr == nil {
+			c.writeData(ctx, strings.NewReader(""))
+		}
+		return nil, senderErr
+	}
+	if len(rejected) == len(recipients) {
+		if dataErr == nil {
+			// The server should have refused DATA, send an empty message
+			// so the transaction can be reset
+			c.writeData(ctx, strings.NewReader(""))
+		}
+		return rejected, errors.NewError(ClientErrNoValidRecipients).WithError(rejected[recipients[0]])
+	}
+	if dataErr != nil {
+		return nil, dataErr
+	}
+
+	return rejected, c.writeData(ctx, data)
+}
+
+func (c *Client) writeData(ctx context.Context, data io.Reader) error {
+	// Every block of data gets its own timeout
+	err := c.withDeadline(ctx, c.Timeouts.DataBlock, func() error {
+		writer := newDotWriter(bufio.NewWriter(&blockWriter{
+			ctx:     ctx,
+			conn:    c.conn,
+			timeout: c.Timeouts.DataBlock,
+		}))
+		if _, err := io.Copy(writer, data); err != nil {
+			return err
+		}
+		return writer.Close()
+	})
+	if err != nil {
 		return err
 	}
 
-	fmt.Fprintf(c.conn, "%s\r\n.\r\n", data)
-	resp, err = c.getReplies()
+	resp, err := c.readReplies(ctx, c.Timeouts.DataEnd)
 	if err != nil {
 		return err
 	}
@@ -149,19 +422,117 @@ func (c *Client) SendData(data string) error {
 	return getResponseError(resp)
 }
 
+func getDataResponseError(replies []clientServerReply) error {
+	if replies[0].Code != 354 {
+		return replyError(replies)
+	}
+	return nil
+}
+
 func getResponseError(replies []clientServerReply) error {
 	if replies[0].Code != 250 {
-		err := errors.NewError(ClientErrReceivedServerError)
-		for i, line := range replies {
-			err = err.WithInfo("RECV line %d: %d %s", i, line.Code, line.Text)
+		return replyError(replies)
+	}
+	return nil
+}
+
+func replyError(replies []clientServerReply) error {
+	// 5xx replies mean trying again (here or elsewhere) won't help
+	errtype := ClientErrReceivedServerError
+	if replies[0].Code >= 500 {
+		errtype = ClientErrRejectedByServer
+	}
+	err := errors.NewError(errtype)
+	for i, line := range replies {
+		err = err.WithInfo("RECV line %d: %d %s", i, line.Code, line.Text)
+	}
+	return err
+}
+
+// command sends a command and waits for the server's reply
+func (c *Client) command(ctx context.Context, timeout time.Duration, format string, a ...interface{}) ([]clientServerReply, error) {
+	var replies []clientServerReply
+	err := c.withDeadline(ctx, timeout, func() error {
+		if err := c.cmd(format, a...); err != nil {
+			return err
 		}
+		var err error
+		replies, err = c.getReplies()
 		return err
+	})
+	return replies, err
+}
+
+// readReplies waits for a reply without sending anything
+func (c *Client) readReplies(ctx context.Context, timeout time.Duration) ([]clientServerReply, error) {
+	var replies []clientServerReply
+	err := c.withDeadline(ctx, timeout, func() error {
+		var err error
+		replies, err = c.getReplies()
+		return err
+	})
+	return replies, err
+}
+
+// withDeadline runs an exchange with the server, interrupting it if it takes
+// longer than the timeout or the context is cancelled
+func (c *Client) withDeadline(ctx context.Context, timeout time.Duration, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return errors.NewError(ClientErrCancelled).WithError(err)
 	}
-	return nil
+
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	c.conn.SetDeadline(deadline)
+
+	// Unblock pending reads and writes if the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(aLongTimeAgo)
+	})
+	err := fn()
+	stop()
+	c.conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return errors.NewError(ClientErrCancelled).WithError(ctxErr)
+		}
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			return errors.NewError(ClientErrTimeout).WithError(err)
+		}
+	}
+	return err
+}
+
+func (c *Client) cmd(format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(c.conn, format+"\r\n", a...)
+	return err
+}
+
+// blockWriter pushes the write deadline forward on each block written
+type blockWriter struct {
+	ctx     context.Context
+	conn    net.Conn
+	timeout time.Duration
 }
 
-func (c *Client) cmd(format string, a ...interface{}) {
-	fmt.Fprintf(c.conn, format+"\r\n", a...)
+func (w *blockWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		deadline := time.Now().Add(w.timeout)
+		if ctxDeadline, ok := w.ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		// Don't undo the deadline set to interrupt us
+		if w.ctx.Err() == nil {
+			w.conn.SetWriteDeadline(deadline)
+		}
+	}
+	return w.conn.Write(p)
 }
 
 func (c *Client) getReplies() ([]clientServerReply, error) {
@@ -212,3 +583,20 @@ func (c *Client) getReplies() ([]clientServerReply, error) {
 
 	return replies, nil
 }
+
+// IsPermanentError returns true if an error (or any error it wraps) comes
+// from the server refusing the mail for good, as opposed to temporary
+// failures (4xx replies, network errors) that could go away on retry
+func IsPermanentError(err error) bool {
+	for err != nil {
+		e, ok := err.(*errors.Error)
+		if !ok {
+			return false
+		}
+		if e.Type == ClientErrRejectedByServer || e.Type == ClientErrMessageTooLarge {
+			return true
+		}
+		err = e.SubError
+	}
+	return false
+}
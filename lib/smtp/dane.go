@@ -0,0 +1,117 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ClientErrDANENoMatch = errors.NewType(ErrSrcClient, "server certificate does not match any TLSA record")
+)
+
+// DANEConfig returns a TLS configuration that authenticates the server using
+// its TLSA records instead of the WebPKI (RFC 7672). Only DANE-TA and DANE-EE
+// records are considered, if none are usable the connection is still
+// encrypted but the server can't be authenticated (RFC 7672 section 2.2).
+func DANEConfig(serverName string, records []dns.TLSA) *tls.Config {
+	var usable []dns.TLSA
+	for _, record := range records {
+		if isUsableTLSA(record) {
+			usable = append(usable, record)
+		}
+	}
+
+	return &tls.Config{
+		ServerName: serverName,
+		// Verification is done by us in VerifyConnection
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(usable) < 1 {
+				return nil
+			}
+			return verifyDANE(state, serverName, usable)
+		},
+	}
+}
+
+func isUsableTLSA(record dns.TLSA) bool {
+	if record.Usage != dns.TLSAUsageDANETA && record.Usage != dns.TLSAUsageDANEEE {
+		return false
+	}
+	if record.Selector != dns.TLSASelectorCert && record.Selector != dns.TLSASelectorSPKI {
+		return false
+	}
+	return record.MatchingType <= dns.TLSAMatchSHA512
+}
+
+func verifyDANE(state tls.ConnectionState, serverName string, records []dns.TLSA) error {
+	certs := state.PeerCertificates
+	if len(certs) < 1 {
+		return errors.NewError(ClientErrDANENoMatch).WithInfo("No certificate presented")
+	}
+
+	for _, record := range records {
+		switch record.Usage {
+		case dns.TLSAUsageDANEEE:
+			// Only the key matters, names and expiration are ignored (RFC 7672 section 3.1.1)
+			if matchTLSA(record, certs[0]) {
+				return nil
+			}
+
+		case dns.TLSAUsageDANETA:
+			// Look for the trust anchor in the chain the server sent us
+			for _, cert := range certs[1:] {
+				if !matchTLSA(record, cert) {
+					continue
+				}
+
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+				intermediates := x509.NewCertPool()
+				for _, intermediate := range certs[1:] {
+					intermediates.AddCert(intermediate)
+				}
+				_, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       serverName,
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return nil
+				}
+			}
+		}
+	}
+
+	return errors.NewError(ClientErrDANENoMatch).WithInfo("Server: %s", serverName)
+}
+
+func matchTLSA(record dns.TLSA, cert *x509.Certificate) bool {
+	var data []byte
+	switch record.Selector {
+	case dns.TLSASelectorCert:
+		data = cert.Raw
+	case dns.TLSASelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch record.MatchingType {
+	case dns.TLSAMatchFull:
+		return bytes.Equal(data, record.Data)
+	case dns.TLSAMatchSHA256:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], record.Data)
+	case dns.TLSAMatchSHA512:
+		sum := sha512.Sum512(data)
+		return bytes.Equal(sum[:], record.Data)
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hamcha/meiru/lib/dns"
+)
+
+// makeCert creates a certificate for name signed by parent (self-signed if nil)
+func makeCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if !isCA {
+		template.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %s", err.Error())
+	}
+	return cert, key
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func sha512Sum(data []byte) []byte {
+	sum := sha512.Sum512(data)
+	return sum[:]
+}
+
+func TestDANEConfig(t *testing.T) {
+	ca, caKey := makeCert(t, "Test CA", true, nil, nil)
+	leaf, _ := makeCert(t, "mx.example.com", false, ca, caKey)
+	other, _ := makeCert(t, "mx.example.com", false, nil, nil)
+	chain := []*x509.Certificate{leaf, ca}
+
+	tests := []struct {
+		name       string
+		serverName string
+		records    []dns.TLSA
+		certs      []*x509.Certificate
+		ok         bool
+	}{
+		{
+			name:       "DANE-EE SPKI SHA-256",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)}},
+			certs:      chain,
+			ok:         true,
+		},
+		{
+			name:       "DANE-EE full certificate",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorCert, MatchingType: dns.TLSAMatchFull, Data: leaf.Raw}},
+			certs:      chain,
+			ok:         true,
+		},
+		{
+			name:       "DANE-EE certificate SHA-512",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorCert, MatchingType: dns.TLSAMatchSHA512, Data: sha512Sum(leaf.Raw)}},
+			certs:      chain,
+			ok:         true,
+		},
+		{
+			name:       "DANE-EE ignores the server name",
+			serverName: "other.example.net",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)}},
+			certs:      chain,
+			ok:         true,
+		},
+		{
+			name:       "DANE-EE with a different key",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)}},
+			certs:      []*x509.Certificate{other},
+			ok:         false,
+		},
+		{
+			name:       "DANE-EE does not match the issuer",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(ca.RawSubjectPublicKeyInfo)}},
+			certs:      chain,
+			ok:         false,
+		},
+		{
+			name:       "one matching record is enough",
+			serverName: "mx.example.com",
+			records: []dns.TLSA{
+				{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(other.RawSubjectPublicKeyInfo)},
+				{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)},
+			},
+			certs: chain,
+			ok:    true,
+		},
+		{
+			name:       "DANE-TA",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANETA, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(ca.RawSubjectPublicKeyInfo)}},
+			certs:      chain,
+			ok:         true,
+		},
+		{
+			name:       "DANE-TA checks the server name",
+			serverName: "other.example.net",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANETA, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(ca.RawSubjectPublicKeyInfo)}},
+			certs:      chain,
+			ok:         false,
+		},
+		{
+			name:       "DANE-TA without the anchor in the chain",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANETA, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(ca.RawSubjectPublicKeyInfo)}},
+			certs:      []*x509.Certificate{leaf},
+			ok:         false,
+		},
+		{
+			name:       "DANE-TA does not match the leaf",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANETA, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)}},
+			certs:      []*x509.Certificate{leaf},
+			ok:         false,
+		},
+		{
+			name:       "no certificate",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)}},
+			certs:      nil,
+			ok:         false,
+		},
+		{
+			name:       "PKIX usages are not usable",
+			serverName: "mx.example.com",
+			records:    []dns.TLSA{{Usage: dns.TLSAUsagePKIXEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(other.RawSubjectPublicKeyInfo)}},
+			certs:      chain,
+			ok:         true,
+		},
+		{
+			name:       "unknown matching types are not usable",
+			serverName: "mx.example.com",
+			records: []dns.TLSA{
+				{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: 3, Data: sha256Sum(other.RawSubjectPublicKeyInfo)},
+				{Usage: dns.TLSAUsageDANEEE, Selector: dns.TLSASelectorSPKI, MatchingType: dns.TLSAMatchSHA256, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)},
+			},
+			certs: chain,
+			ok:    true,
+		},
+	}
+
+	for _, test := range tests {
+		config := DANEConfig(test.serverName, test.records)
+		err := config.VerifyConnection(tls.ConnectionState{PeerCertificates: test.certs})
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected verification to fail", test.name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"bufio"
+)
+
+// dotWriter encodes mail data for the DATA command (RFC 5321 section 4.5.2):
+// lines starting with "." get an extra "." and line endings are normalized
+// to CRLF. Close writes the terminating "." line.
+type dotWriter struct {
+	w         *bufio.Writer
+	lineStart bool
+	pendingCR bool
+}
+
+func newDotWriter(w *bufio.Writer) *dotWriter {
+	return &dotWriter{
+		w:         w,
+		lineStart: true,
+	}
+}
+
+func (d *dotWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if d.pendingCR {
+			d.pendingCR = false
+			d.w.WriteString("\r\n")
+			d.lineStart = true
+			// CRLF, already written
+			if b == '\n' {
+				continue
+			}
+		}
+
+		switch {
+		case b == '\r':
+			// Wait to see if it's a CRLF or a bare CR
+			d.pendingCR = true
+			continue
+		case b == '\n':
+			// Bare LF
+			d.w.WriteString("\r\n")
+			d.lineStart = true
+			continue
+		case b == '.' && d.lineStart:
+			d.w.WriteByte('.')
+		}
+
+		d.w.WriteByte(b)
+		d.lineStart = false
+	}
+
+	return len(p), nil
+}
+
+func (d *dotWriter) Close() error {
+	if d.pendingCR {
+		d.pendingCR = false
+		d.w.WriteString("\r\n")
+		d.lineStart = true
+	}
+	if !d.lineStart {
+		d.w.WriteString("\r\n")
+	}
+	d.w.WriteString(".\r\n")
+	return d.w.Flush()
+}
@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -9,10 +10,15 @@ import (
 	"net"
 	"net/mail"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/hamcha/meiru/lib/dkim"
+	"github.com/hamcha/meiru/lib/dmarc"
+	"github.com/hamcha/meiru/lib/dns"
 	"github.com/hamcha/meiru/lib/email"
 	"github.com/hamcha/meiru/lib/errors"
+	"github.com/hamcha/meiru/lib/spf"
 )
 
 var (
@@ -24,17 +30,35 @@ var (
 type ReceivedMailHandler func(e ServerEnvelope)
 type AuthRequestHandler func(user, pass string) bool
 
+// RecipientCheckHandler returns true if a local address can receive mail
+type RecipientCheckHandler func(address string) bool
+
 type Server struct {
 	svsocket net.Listener
 
 	// Server info
-	Hostname     string
-	MaxSize      uint64
-	LocalDomains []string
-	RequireAuth  bool
-
-	OnAuthRequest  AuthRequestHandler
-	OnReceivedMail ReceivedMailHandler
+	Hostname    string
+	MaxSize     uint64
+	RequireAuth bool
+
+	// Domains mail is received for, see SetLocalDomains
+	localDomains map[string]bool
+	domainsLock  sync.RWMutex
+
+	// Inbound checks, only performed on mail from unauthenticated clients
+	Resolver      dns.Resolver
+	VerifyDKIM    bool
+	CheckSPF      bool
+	RejectSPFFail bool
+	CheckDMARC    bool
+	EnforceDMARC  bool
+
+	// Collects DMARC results for aggregate reports (nil disables reporting)
+	DMARCReports *dmarc.Reporter
+
+	OnAuthRequest    AuthRequestHandler
+	OnReceivedMail   ReceivedMailHandler
+	OnRecipientCheck RecipientCheckHandler
 }
 
 type ServerEnvelope struct {
@@ -42,6 +66,17 @@ type ServerEnvelope struct {
 	Sender     string
 	Recipients []string
 	Data       string
+
+	// Results of inbound checks, added as an Authentication-Results header
+	AuthResults []string
+	SPFResult   spf.Result
+	SPFDomain   string
+
+	// Set when the DMARC policy of the sender asks for quarantine, the mail
+	// is then marked with an X-Quarantine header
+	Quarantine bool
+
+	open bool
 }
 
 type serverClient struct {
@@ -60,6 +95,7 @@ type serverClient struct {
 
 const MeiruMOTD = "meiru-SMTPd - Welcome!"
 const DefaultMaxSize uint64 = 10485760 // 10 MiB
+const AuthCheckTimeout = 30 * time.Second
 
 func NewServer(bindAddr string, hostname string) (*Server, error) {
 	if strings.IndexRune(bindAddr, ':') < 0 {
@@ -193,7 +229,7 @@ func (c *serverClient) DoCommand(line string) bool {
 			break
 		}
 		// Reject if there is a envelope already active
-		if len(c.currentEnvelope.Sender) > 0 {
+		if c.currentEnvelope.open {
 			c.reply(503, "An envelope is already open, call RSET if you want to start over")
 			break
 		}
@@ -210,23 +246,28 @@ func (c *serverClient) DoCommand(line string) bool {
 		}
 		trimmed := strings.TrimSpace(line[10 : 11+addrlast])
 
-		// Try to parse address
-		addr, err := mail.ParseAddress(trimmed)
-		if err != nil || !email.IsValidAddress(addr.Address) {
-			c.reply(501, "The address you specified is malformed (cannot parse)")
-			break
+		// Accept the null sender (used by bounces) only from other servers
+		sender := ""
+		if trimmed != "<>" || c.authenticated {
+			// Try to parse address
+			addr, err := mail.ParseAddress(trimmed)
+			if err != nil || !email.IsValidAddress(addr.Address) {
+				c.reply(501, "The address you specified is malformed (cannot parse)")
+				break
+			}
+			sender = addr.Address
 		}
 
 		// Check if local address (require auth)
-		if c.IsAddressInternal(addr.Address) && c.server.RequireAuth {
+		if sender != "" && c.IsAddressInternal(sender) && c.server.RequireAuth {
 			// Check if client is authenticated
 			if !c.authenticated {
 				c.reply(530, "Emails from this domain require authentication. Please authenticate first!")
 				break
 			} else {
 				// Check if authenticated for a different address
-				if strings.ToLower(c.authName) != strings.ToLower(addr.Address) {
-					errstr := fmt.Sprintf("Authenticated for a different address (%s), use that or authenticate as \"%s\" instead!", c.authName, addr)
+				if strings.ToLower(c.authName) != strings.ToLower(sender) {
+					errstr := fmt.Sprintf("Authenticated for a different address (%s), use that or authenticate as \"%s\" instead!", c.authName, sender)
 					c.reply(530, errstr)
 					break
 				}
@@ -236,14 +277,20 @@ func (c *serverClient) DoCommand(line string) bool {
 		// Set envelope client if not set
 		c.currentEnvelope.Client = c
 
+		// Check if the client is allowed to send for the sender's domain
+		if !c.authenticated && !c.checkSPF(sender) {
+			break
+		}
+
 		// Set address as sender
-		c.currentEnvelope.Sender = addr.Address
+		c.currentEnvelope.Sender = sender
+		c.currentEnvelope.open = true
 		c.reply(250, "OK 👍")
 
 	// RCPT TO: Add recipient to envelope
 	case strings.HasPrefix(cmd, "RCPT TO:"):
 		// Reject if there isn't an active envelope
-		if len(c.currentEnvelope.Sender) < 1 {
+		if !c.currentEnvelope.open {
 			c.reply(503, "No envelopes to add recipients to, please start one with MAIL FROM")
 			break
 		}
@@ -289,6 +336,12 @@ func (c *serverClient) DoCommand(line string) bool {
 			break
 		}
 
+		// Refuse local addresses nobody would receive mail for
+		if c.server.OnRecipientCheck != nil && c.IsAddressInternal(addr.Address) && !c.server.OnRecipientCheck(addr.Address) {
+			c.reply(550, "5.1.1 No such user here")
+			break
+		}
+
 		// Add address to recipients
 		c.currentEnvelope.Recipients = append(c.currentEnvelope.Recipients, addr.Address)
 		c.reply(250, "OK 👍")
@@ -296,7 +349,7 @@ func (c *serverClient) DoCommand(line string) bool {
 	// DATA: Receive mail data from client
 	case strings.HasPrefix(cmd, "DATA"):
 		// Reject if there isn't an active envelope
-		if len(c.currentEnvelope.Sender) < 1 || len(c.currentEnvelope.Recipients) < 1 {
+		if !c.currentEnvelope.open || len(c.currentEnvelope.Recipients) < 1 {
 			c.reply(503, "Please specify both a sender and at least one recipient first")
 			break
 		}
@@ -315,11 +368,23 @@ func (c *serverClient) DoCommand(line string) bool {
 			log.Printf("[SMTPd] Client read error: %s\r\n", err.Error())
 			return false
 		}
+		// Run checks on mail coming from other servers
+		if !c.authenticated && !c.checkInbound() {
+			c.currentEnvelope = ServerEnvelope{
+				Client: c,
+			}
+			break
+		}
 		// Add metadata to envelope
 		c.currentEnvelope.AddEnvelopeMetadata()
 		c.server.OnReceivedMail(c.currentEnvelope)
 		c.reply(250, "Your message is on its way! ✈")
 
+		// Get ready for the next message
+		c.currentEnvelope = ServerEnvelope{
+			Client: c,
+		}
+
 	// AUTH: Authenticate client
 	case strings.HasPrefix(cmd, "AUTH"):
 		parts := strings.Split(strings.TrimSpace(line), " ")
@@ -467,22 +532,206 @@ func (c *serverClient) readDATA() (string, error) {
 		if checkNext && line == "." {
 			break
 		}
+		// Undo dot-stuffing (RFC 5321 section 4.5.2)
+		if strings.HasPrefix(line, ".") {
+			line = line[1:]
+		}
 		data += line + "\r\n"
 	}
 
 	return strings.TrimRight(data, "\r\n"), nil
 }
 
-func (c serverClient) IsAddressInternal(addr string) bool {
-	atIndex := strings.LastIndexByte(addr, '@')
-	remoteDomain := strings.ToLower(addr[atIndex+1:])
-	for _, localDomain := range c.server.LocalDomains {
-		if strings.ToLower(localDomain) == remoteDomain {
+// checkSPF evaluates the SPF policy for the sender (or HELO identity for
+// the null sender), returns false if the sender was rejected
+func (c *serverClient) checkSPF(sender string) bool {
+	if c.server.Resolver == nil || !c.server.CheckSPF {
+		return true
+	}
+
+	clientHost, _, _ := net.SplitHostPort(c.SourceAddr.String())
+	ip := net.ParseIP(clientHost)
+	if ip == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AuthCheckTimeout)
+	defer cancel()
+
+	result, explanation, err := spf.Check(ctx, c.server.Resolver, ip, sender, c.Hostname)
+	if err != nil {
+		log.Printf("[SMTPd] SPF check for %s from %s: %s\r\n", sender, clientHost, err.Error())
+	}
+
+	if result == spf.Fail && c.server.RejectSPFFail {
+		if explanation == "" {
+			explanation = fmt.Sprintf("%s is not allowed to send mail for this domain", clientHost)
+		}
+		c.reply(550, "5.7.23 SPF check failed: "+explanation)
+		return false
+	}
+
+	identity := "smtp.mailfrom=" + sender
+	c.currentEnvelope.SPFDomain = sender[strings.LastIndexByte(sender, '@')+1:]
+	if sender == "" {
+		identity = "smtp.helo=" + c.Hostname
+		c.currentEnvelope.SPFDomain = c.Hostname
+	}
+	c.currentEnvelope.SPFResult = result
+	c.currentEnvelope.AuthResults = append(c.currentEnvelope.AuthResults, fmt.Sprintf("spf=%s %s", result, identity))
+	return true
+}
+
+// checkInbound verifies DKIM signatures and applies the DMARC policy of
+// the sender, returns false if the mail was rejected
+func (c *serverClient) checkInbound() bool {
+	if c.server.Resolver == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AuthCheckTimeout)
+	defer cancel()
+
+	var signatures []dkim.Result
+	if c.server.VerifyDKIM {
+		signatures = dkim.Verify(ctx, c.server.Resolver, c.currentEnvelope.Data)
+		for _, result := range signatures {
+			c.currentEnvelope.AuthResults = append(c.currentEnvelope.AuthResults, result.String())
+		}
+	}
+
+	if !c.server.CheckDMARC {
+		return true
+	}
+
+	// Which domain's policy applies is ambiguous, and picking one would let
+	// spoofers skip it (RFC 7489 section 6.6.1)
+	domains, ok := fromDomains(c.currentEnvelope.Data)
+	if !ok {
+		c.currentEnvelope.AuthResults = append(c.currentEnvelope.AuthResults, "dmarc=permerror (invalid or multiple From headers)")
+		if !c.server.EnforceDMARC {
 			return true
 		}
+		log.Printf("[SMTPd] Rejecting mail from %s with invalid or multiple From headers\r\n", c.currentEnvelope.Sender)
+		c.reply(550, "5.7.1 Messages must have a single valid From header")
+		return false
+	}
+	// Without a From header there is no policy to look for
+	if len(domains) < 1 {
+		domains = []string{""}
+	}
+
+	// With several authors, the strictest of their policies is applied
+	var strictest dmarc.Result
+	for i, domain := range domains {
+		result := dmarc.Evaluate(ctx, c.server.Resolver, dmarc.Input{
+			FromDomain: domain,
+			SPF:        c.currentEnvelope.SPFResult,
+			SPFDomain:  c.currentEnvelope.SPFDomain,
+			DKIM:       signatures,
+		})
+		c.currentEnvelope.AuthResults = append(c.currentEnvelope.AuthResults, result.String())
+
+		if c.server.DMARCReports != nil {
+			clientHost, _, _ := net.SplitHostPort(c.SourceAddr.String())
+			if ip := net.ParseIP(clientHost); ip != nil {
+				c.server.DMARCReports.Add(ip, result)
+			}
+		}
+
+		if i == 0 || policyStrictness[result.Disposition] > policyStrictness[strictest.Disposition] {
+			strictest = result
+		}
+	}
+
+	if !c.server.EnforceDMARC {
+		return true
+	}
+	switch strictest.Disposition {
+	case dmarc.PolicyReject:
+		log.Printf("[SMTPd] Rejecting mail from %s per DMARC policy\r\n", strictest.FromDomain)
+		c.reply(550, "5.7.1 Rejected per DMARC policy of the sender's domain")
+		return false
+	case dmarc.PolicyQuarantine:
+		c.currentEnvelope.Quarantine = true
+	}
+	return true
+}
+
+// policyStrictness orders DMARC policies from the mildest to the strictest
+var policyStrictness = map[dmarc.Policy]int{
+	dmarc.PolicyNone:       0,
+	dmarc.PolicyQuarantine: 1,
+	dmarc.PolicyReject:     2,
+}
+
+// fromDomains returns the domains of the authors in the From header (none if
+// there is no From header). It returns false if there is more than one From
+// header or its addresses can't be parsed.
+func fromDomains(data string) ([]string, bool) {
+	// Scan the headers ourselves, an error anywhere else in them must not
+	// make the From header go unnoticed
+	var from []string
+	for _, field := range email.Parse(data).Fields() {
+		colon := strings.IndexByte(field, ':')
+		if colon > 0 && strings.EqualFold(strings.TrimRight(field[:colon], " \t"), "From") {
+			from = append(from, field[colon+1:])
+		}
+	}
+	switch len(from) {
+	case 0:
+		return nil, true
+	case 1:
+	default:
+		return nil, false
+	}
+
+	// Unfold before parsing
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(from[0])
+	authors, err := mail.ParseAddressList(strings.TrimSpace(value))
+	if err != nil || len(authors) < 1 {
+		return nil, false
+	}
+
+	var domains []string
+	seen := make(map[string]bool)
+	for _, author := range authors {
+		_, domain := email.SplitAddress(author.Address)
+		domain = strings.ToLower(domain)
+		if domain == "" {
+			return nil, false
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
 	}
+	return domains, true
+}
+
+// SetLocalDomains replaces the list of domains the server receives mail for,
+// it can be called while the server is running
+func (s *Server) SetLocalDomains(domains []string) {
+	localDomains := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		localDomains[strings.ToLower(domain)] = true
+	}
+
+	s.domainsLock.Lock()
+	s.localDomains = localDomains
+	s.domainsLock.Unlock()
+}
+
+// IsLocalDomain returns true if the server receives mail for a domain
+func (s *Server) IsLocalDomain(domain string) bool {
+	s.domainsLock.RLock()
+	defer s.domainsLock.RUnlock()
+	return s.localDomains[strings.ToLower(domain)]
+}
 
-	return false
+func (c serverClient) IsAddressInternal(addr string) bool {
+	atIndex := strings.LastIndexByte(addr, '@')
+	return c.server.IsLocalDomain(addr[atIndex+1:])
 }
 
 func (e *ServerEnvelope) AddEnvelopeMetadata() {
@@ -496,7 +745,47 @@ func (e *ServerEnvelope) AddEnvelopeMetadata() {
 
 	ReturnPath := fmt.Sprintf("Return-Path: <%s>\n", e.Sender)
 
-	e.Data = Received + ReturnPath + e.Data
+	// Results claiming to come from us are forged, whether or not we add any
+	// (RFC 8601 section 5)
+	e.Data = email.RemoveHeaderFunc(e.Data, "Authentication-Results", func(value string) bool {
+		return strings.EqualFold(authServID(value), e.Client.server.Hostname)
+	})
+
+	AuthResults := ""
+	if len(e.AuthResults) > 0 {
+		// Results added by whoever sent us the mail cannot be trusted
+		e.Data = email.RemoveHeader(e.Data, "Authentication-Results")
+		AuthResults = fmt.Sprintf(
+			"Authentication-Results: %s;\n\t%s\n",
+			e.Client.server.Hostname,
+			strings.Join(e.AuthResults, ";\n\t"))
+	}
+
+	// Let the user's mail client file it away, the store can't do it yet
+	Quarantine := ""
+	if e.Quarantine {
+		e.Data = email.RemoveHeader(e.Data, "X-Quarantine")
+		Quarantine = "X-Quarantine: dmarc\n"
+	}
+
+	e.Data = Received + ReturnPath + AuthResults + Quarantine + e.Data
+}
+
+// authServID returns the authserv-id an Authentication-Results header
+// value starts with, skipping comments (RFC 8601 section 2.2)
+func authServID(value string) string {
+	value = strings.TrimSpace(value)
+	for strings.HasPrefix(value, "(") {
+		end := strings.IndexByte(value, ')')
+		if end < 0 {
+			return ""
+		}
+		value = strings.TrimSpace(value[end+1:])
+	}
+	if end := strings.IndexAny(value, "; \t\r\n("); end >= 0 {
+		value = value[:end]
+	}
+	return strings.Trim(value, "\"")
 }
 
 func (e ServerEnvelope) isInternal() bool {
@@ -0,0 +1,164 @@
+package spf
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+// expand expands the macros in a domain-spec or explanation string
+// (RFC 7208 section 7). The c, r and t macros are only allowed in explanations.
+func (c *checker) expand(spec, domain string, explanation bool) (string, *errors.Error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+
+		i++
+		if i >= len(spec) {
+			return "", errors.NewError(SPFErrInvalidMacro).WithInfo("dangling %% in \"%s\"", spec)
+		}
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", errors.NewError(SPFErrInvalidMacro).WithInfo("unterminated macro in \"%s\"", spec)
+			}
+			value, err := c.expandMacro(spec[i+1:i+end], domain, explanation)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i += end
+		default:
+			return "", errors.NewError(SPFErrInvalidMacro).WithInfo("invalid escape %%%c in \"%s\"", spec[i], spec)
+		}
+	}
+
+	return out.String(), nil
+}
+
+// expandMacro expands the contents of a single %{...} macro
+func (c *checker) expandMacro(macro, domain string, explanation bool) (string, *errors.Error) {
+	if len(macro) < 1 {
+		return "", errors.NewError(SPFErrInvalidMacro).WithInfo("empty macro")
+	}
+
+	letter := macro[0]
+	value := ""
+	at := strings.LastIndexByte(c.sender, '@')
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = c.sender[:at]
+	case 'o':
+		value = c.sender[at+1:]
+	case 'd':
+		value = domain
+	case 'i':
+		value = c.dottedIP()
+	case 'p':
+		value = c.validatedName(domain)
+		if value == "" {
+			value = "unknown"
+		}
+	case 'v':
+		value = "ip6"
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case 'h':
+		value = c.helo
+	case 'c', 'r', 't':
+		if !explanation {
+			return "", errors.NewError(SPFErrInvalidMacro).WithInfo("%%{%c} is only allowed in explanations", letter)
+		}
+		switch letter | 0x20 {
+		case 'c':
+			value = c.ip.String()
+		case 'r':
+			value = "unknown"
+		case 't':
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	default:
+		return "", errors.NewError(SPFErrInvalidMacro).WithInfo("unknown macro letter %c", letter)
+	}
+
+	// Parse transformers: number of parts to keep and reversal
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n < 1 {
+			return "", errors.NewError(SPFErrInvalidMacro).WithInfo("invalid part count in %%{%s}", macro)
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if len(rest) > 0 {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", errors.NewError(SPFErrInvalidMacro).WithInfo("invalid delimiters in %%{%s}", macro)
+		}
+		delimiters = rest
+	}
+
+	if keep > 0 || reverse || delimiters != "." {
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		value = strings.Join(parts, ".")
+	}
+
+	// Uppercase macros are URL escaped
+	if letter >= 'A' && letter <= 'Z' {
+		value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+
+	return value, nil
+}
+
+// dottedIP formats the client IP for the i macro, IPv6 addresses are
+// written as dot-separated nibbles
+func (c *checker) dottedIP() string {
+	if ip4 := c.ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	nibbles := make([]string, 0, 32)
+	for _, b := range c.ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,526 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hamcha/meiru/lib/dns"
+	"github.com/hamcha/meiru/lib/errors"
+)
+
+var (
+	ErrSrcSPF errors.ErrorSource = "spf"
+
+	SPFErrLookupFailed    = errors.NewType(ErrSrcSPF, "DNS lookup failed")
+	SPFErrMultipleRecords = errors.NewType(ErrSrcSPF, "domain has more than one SPF record")
+	SPFErrInvalidRecord   = errors.NewType(ErrSrcSPF, "invalid SPF record")
+	SPFErrInvalidMacro    = errors.NewType(ErrSrcSPF, "invalid macro")
+	SPFErrTooManyLookups  = errors.NewType(ErrSrcSPF, "too many DNS lookups")
+	SPFErrNoRecord        = errors.NewType(ErrSrcSPF, "redirect or include target has no SPF record")
+)
+
+// Result is the outcome of an SPF check (RFC 7208 section 2.6)
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Limits from RFC 7208 section 4.6.4
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+	maxNames       = 10
+)
+
+type checker struct {
+	ctx      context.Context
+	resolver dns.Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+
+	lookups     int
+	voidLookups int
+}
+
+// Check evaluates the SPF policy of the sender's domain for a client IP.
+// For the null sender the HELO identity is checked instead. When the result
+// is Fail, the explanation published by the domain (if any) is also returned.
+func Check(ctx context.Context, resolver dns.Resolver, ip net.IP, sender, helo string) (Result, string, error) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	at := strings.LastIndexByte(sender, '@')
+	if at < 0 {
+		sender = "postmaster@" + sender
+		at = len("postmaster")
+	}
+
+	c := &checker{
+		ctx:      ctx,
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+
+	result, explanation, err := c.checkHost(sender[at+1:])
+	if err != nil {
+		return result, "", err
+	}
+	return result, explanation, nil
+}
+
+// resultFor maps an evaluation error to its SPF result
+func resultFor(err *errors.Error) Result {
+	if err.Type == SPFErrLookupFailed {
+		return TempError
+	}
+	return PermError
+}
+
+func (c *checker) checkHost(domain string) (Result, string, *errors.Error) {
+	if !validDomain(domain) {
+		return None, "", nil
+	}
+
+	record, err := c.getRecord(domain)
+	if err != nil {
+		return resultFor(err), "", err
+	}
+	if record == "" {
+		return None, "", nil
+	}
+
+	// Collect modifiers first, they apply regardless of their position
+	var mechanisms []string
+	redirect, exp := "", ""
+	for _, term := range strings.Fields(record)[1:] {
+		name, value, isModifier := splitModifier(term)
+		if !isModifier {
+			mechanisms = append(mechanisms, term)
+			continue
+		}
+		switch name {
+		case "redirect":
+			if redirect != "" {
+				err := errors.NewError(SPFErrInvalidRecord).WithInfo("duplicate redirect modifier in %s", domain)
+				return PermError, "", err
+			}
+			redirect = value
+		case "exp":
+			if exp != "" {
+				err := errors.NewError(SPFErrInvalidRecord).WithInfo("duplicate exp modifier in %s", domain)
+				return PermError, "", err
+			}
+			exp = value
+		}
+		// Unknown modifiers are ignored
+	}
+
+	for _, term := range mechanisms {
+		qualifier := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = Fail, term[1:]
+		case '~':
+			qualifier, term = SoftFail, term[1:]
+		case '?':
+			qualifier, term = Neutral, term[1:]
+		}
+
+		match, err := c.matchMechanism(domain, term)
+		if err != nil {
+			return resultFor(err), "", err
+		}
+		if match {
+			explanation := ""
+			if qualifier == Fail && exp != "" {
+				explanation = c.explain(domain, exp)
+			}
+			return qualifier, explanation, nil
+		}
+	}
+
+	// Nothing matched, follow the redirect if there is one
+	if redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return PermError, "", err
+		}
+		target, err := c.expand(redirect, domain, false)
+		if err != nil {
+			return PermError, "", err
+		}
+		result, explanation, err := c.checkHost(target)
+		if err == nil && result == None {
+			err = errors.NewError(SPFErrNoRecord).WithInfo("redirect to %s", target)
+			return PermError, "", err
+		}
+		return result, explanation, err
+	}
+
+	return Neutral, "", nil
+}
+
+// getRecord fetches the SPF record of a domain, empty if there is none
+func (c *checker) getRecord(domain string) (string, *errors.Error) {
+	records, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.NewError(SPFErrLookupFailed).WithError(err).WithInfo("TXT lookup for %s", domain)
+	}
+
+	found := ""
+	for _, record := range records {
+		lower := strings.ToLower(record)
+		if lower != "v=spf1" && !strings.HasPrefix(lower, "v=spf1 ") {
+			continue
+		}
+		if found != "" {
+			return "", errors.NewError(SPFErrMultipleRecords).WithInfo("domain: %s", domain)
+		}
+		found = record
+	}
+
+	return found, nil
+}
+
+func (c *checker) matchMechanism(domain, term string) (bool, *errors.Error) {
+	name, arg, cidr := splitMechanism(term)
+	invalid := func() (bool, *errors.Error) {
+		return false, errors.NewError(SPFErrInvalidRecord).WithInfo("invalid mechanism \"%s\" in %s", term, domain)
+	}
+
+	switch name {
+	case "all":
+		if arg != "" || cidr != "" {
+			return invalid()
+		}
+		return true, nil
+
+	case "include":
+		if arg == "" || cidr != "" {
+			return invalid()
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain, false)
+		if err != nil {
+			return false, err
+		}
+		result, _, err := c.checkHost(target)
+		switch result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case None:
+			return false, errors.NewError(SPFErrNoRecord).WithInfo("include of %s", target)
+		}
+		return false, err
+
+	case "a", "mx":
+		v4, v6, ok := parseDualCIDR(cidr)
+		if !ok {
+			return invalid()
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target := domain
+		if arg != "" {
+			expanded, err := c.expand(arg, domain, false)
+			if err != nil {
+				return false, err
+			}
+			target = expanded
+		}
+		if name == "a" {
+			return c.matchHost(target, v4, v6)
+		}
+		return c.matchMX(target, v4, v6)
+
+	case "ptr":
+		if cidr != "" {
+			return invalid()
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target := domain
+		if arg != "" {
+			expanded, err := c.expand(arg, domain, false)
+			if err != nil {
+				return false, err
+			}
+			target = expanded
+		}
+		return c.validatedName(target) != "", nil
+
+	case "ip4", "ip6":
+		network := net.ParseIP(arg)
+		if network == nil || (name == "ip4") != (network.To4() != nil) {
+			return invalid()
+		}
+		bits := 128
+		if name == "ip4" {
+			bits = 32
+		}
+		prefix := bits
+		if cidr != "" {
+			var err error
+			prefix, err = strconv.Atoi(cidr[1:])
+			if err != nil || prefix < 0 || prefix > bits {
+				return invalid()
+			}
+		}
+		return matchIP(c.ip, network, prefix, prefix), nil
+
+	case "exists":
+		if arg == "" || cidr != "" {
+			return invalid()
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain, false)
+		if err != nil {
+			return false, err
+		}
+		ips, lerr := c.lookupIP(target)
+		if lerr != nil {
+			return false, lerr
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return invalid()
+}
+
+// matchHost checks the client IP against the addresses of a host
+func (c *checker) matchHost(host string, v4, v6 int) (bool, *errors.Error) {
+	ips, err := c.lookupIP(host)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		if matchIP(c.ip, ip, v4, v6) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchMX checks the client IP against the addresses of a domain's MX hosts
+func (c *checker) matchMX(domain string, v4, v6 int) (bool, *errors.Error) {
+	records, err := c.resolver.LookupMX(c.ctx, domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return false, c.countVoidLookup()
+		}
+		return false, errors.NewError(SPFErrLookupFailed).WithError(err).WithInfo("MX lookup for %s", domain)
+	}
+	if len(records) > maxNames {
+		return false, errors.NewError(SPFErrTooManyLookups).WithInfo("%s has more than %d MX records", domain, maxNames)
+	}
+
+	for _, mx := range records {
+		match, err := c.matchHost(strings.TrimSuffix(mx.Host, "."), v4, v6)
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+// validatedName returns a name of the client, confirmed by a forward lookup,
+// which is the target domain or one of its subdomains
+func (c *checker) validatedName(target string) string {
+	names, err := c.resolver.LookupAddr(c.ctx, c.ip.String())
+	if err != nil {
+		// Errors here are not fatal (RFC 7208 section 5.5)
+		return ""
+	}
+	if len(names) > maxNames {
+		names = names[:maxNames]
+	}
+
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		ips, err := c.resolver.LookupIP(c.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(c.ip) {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+func (c *checker) lookupIP(host string) ([]net.IP, *errors.Error) {
+	ips, err := c.resolver.LookupIP(c.ctx, host)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, c.countVoidLookup()
+		}
+		return nil, errors.NewError(SPFErrLookupFailed).WithError(err).WithInfo("address lookup for %s", host)
+	}
+	return ips, nil
+}
+
+func (c *checker) countLookup() *errors.Error {
+	c.lookups++
+	if c.lookups > maxLookups {
+		return errors.NewError(SPFErrTooManyLookups).WithInfo("limit is %d", maxLookups)
+	}
+	return nil
+}
+
+func (c *checker) countVoidLookup() *errors.Error {
+	c.voidLookups++
+	if c.voidLookups > maxVoidLookups {
+		return errors.NewError(SPFErrTooManyLookups).WithInfo("more than %d lookups returned no records", maxVoidLookups)
+	}
+	return nil
+}
+
+// explain fetches and expands the explanation for a failed check,
+// any error simply results in no explanation (RFC 7208 section 6.2)
+func (c *checker) explain(domain, exp string) string {
+	target, err := c.expand(exp, domain, false)
+	if err != nil {
+		return ""
+	}
+	records, lerr := c.resolver.LookupTXT(c.ctx, target)
+	if lerr != nil || len(records) != 1 {
+		return ""
+	}
+	explanation, err := c.expand(records[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	return explanation
+}
+
+// splitModifier checks if a term is a modifier (name=value)
+func splitModifier(term string) (string, string, bool) {
+	eq := strings.IndexByte(term, '=')
+	if eq < 1 {
+		return "", "", false
+	}
+	name := term[:eq]
+	for i, chr := range name {
+		isAlpha := (chr >= 'a' && chr <= 'z') || (chr >= 'A' && chr <= 'Z')
+		isOther := (chr >= '0' && chr <= '9') || chr == '-' || chr == '_' || chr == '.'
+		if !isAlpha && (i == 0 || !isOther) {
+			return "", "", false
+		}
+	}
+	return strings.ToLower(name), term[eq+1:], true
+}
+
+// splitMechanism splits a mechanism in its name, domain-spec or address,
+// and CIDR length suffix
+func splitMechanism(term string) (name, arg, cidr string) {
+	sep := strings.IndexAny(term, ":/")
+	if sep < 0 {
+		return strings.ToLower(term), "", ""
+	}
+	name = strings.ToLower(term[:sep])
+	rest := term[sep:]
+	if rest[0] != ':' {
+		return name, "", rest
+	}
+	rest = rest[1:]
+	if slash := strings.IndexByte(rest, '/'); slash >= 0 {
+		return name, rest[:slash], rest[slash:]
+	}
+	return name, rest, ""
+}
+
+// parseDualCIDR parses the "/24//64" suffix of the a and mx mechanisms
+func parseDualCIDR(cidr string) (int, int, bool) {
+	v4, v6 := 32, 128
+	if cidr == "" {
+		return v4, v6, true
+	}
+
+	parts := strings.SplitN(cidr, "//", 2)
+	if parts[0] != "" {
+		if parts[0][0] != '/' {
+			return 0, 0, false
+		}
+		n, err := strconv.Atoi(parts[0][1:])
+		if err != nil || n < 0 || n > 32 {
+			return 0, 0, false
+		}
+		v4 = n
+	}
+	if len(parts) > 1 {
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 || n > 128 {
+			return 0, 0, false
+		}
+		v6 = n
+	}
+
+	return v4, v6, true
+}
+
+// matchIP checks if two addresses of the same family share a prefix
+func matchIP(client, network net.IP, v4, v6 int) bool {
+	if client4, network4 := client.To4(), network.To4(); client4 != nil || network4 != nil {
+		if client4 == nil || network4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(v4, 32)
+		return client4.Mask(mask).Equal(network4.Mask(mask))
+	}
+	mask := net.CIDRMask(v6, 128)
+	return client.Mask(mask).Equal(network.Mask(mask))
+}
+
+// validDomain checks if a domain can be checked (RFC 7208 section 4.3)
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) < 1 || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) < 1 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}